@@ -3,4 +3,4 @@
 set -e
 export GOFLAGS="-mod=vendor"
 
-go build -o bin/rest-service-example cmd/rest-service-example/main.go
+go build -o bin/rest-service-example ./cmd/rest-service-example
@@ -0,0 +1,237 @@
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/dbtx"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const DefaultBatchSize = 1000
+
+// BatchFunc processes up to limit rows with keys greater than after in
+// the key order. It returns the key of the last processed row and the number
+// of processed rows. Zero rows means the backfill is complete.
+type BatchFunc func(ctx context.Context, tx pgx.Tx, after int64, limit int) (last int64, rows int, err error)
+
+// Backfill is a data migration which is too large for a single transaction,
+// e.g. an UPDATE of every row of a big table. Rows are processed in batches,
+// each one in a separate transaction along with the progress update, so
+// a backfill can be interrupted and resumed at any point.
+type Backfill struct {
+	// Name identifies the backfill in the progress table, it should never change
+	Name string
+	// Batch is called repeatedly until it returns zero rows. It can be
+	// called several times for the same rows if a transaction is retried.
+	Batch BatchFunc
+	// BatchSize is the limit passed to Batch, DefaultBatchSize if zero
+	BatchSize int
+	// Delay between batches, to limit the load on the database
+	Delay time.Duration
+}
+
+// Progress is a row of the progress table. StartedAt is nil if the
+// backfill was never run.
+type Progress struct {
+	Name       string
+	LastKey    int64
+	Rows       int64
+	StartedAt  *time.Time
+	UpdatedAt  *time.Time
+	FinishedAt *time.Time
+}
+
+type Runner struct {
+	pool          *pgxpool.Pool
+	progressTable string
+	backfills     []Backfill
+}
+
+// NewRunner creates a runner storing progress of the backfills in
+// progressTable. The table is created if it doesn't exist.
+func NewRunner(ctx context.Context, pool *pgxpool.Pool, progressTable string) (*Runner, error) {
+	_, err := pool.Exec(ctx, fmt.Sprintf(`
+    create table if not exists %s(
+      name text primary key,
+      last_key int8 not null,
+      rows_done int8 not null,
+      started_at timestamptz not null,
+      updated_at timestamptz not null,
+      finished_at timestamptz
+    )
+  `, progressTable))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create the backfill progress table")
+	}
+
+	return &Runner{pool: pool, progressTable: progressTable}, nil
+}
+
+// Register adds a backfill which can be run by name
+func (r *Runner) Register(b Backfill) error {
+	if b.Name == "" || b.Batch == nil {
+		return fmt.Errorf("Backfill should have a name and a batch function")
+	}
+
+	if _, ok := r.find(b.Name); ok {
+		return fmt.Errorf("Duplicate backfill %s", b.Name)
+	}
+
+	r.backfills = append(r.backfills, b)
+	return nil
+}
+
+func (r *Runner) find(name string) (Backfill, bool) {
+	for _, b := range r.backfills {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return Backfill{}, false
+}
+
+// Run processes the remaining rows of the backfill. It returns when all the
+// rows are processed, a batch fails or ctx is canceled. In the last two
+// cases the next Run continues after the last committed batch.
+func (r *Runner) Run(ctx context.Context, name string) error {
+	b, ok := r.find(name)
+	if !ok {
+		return fmt.Errorf("Unknown backfill %s", name)
+	}
+
+	batchSize := b.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	_, err := r.pool.Exec(ctx, fmt.Sprintf(`
+    insert into %s(name, last_key, rows_done, started_at, updated_at) values ($1, $2, 0, now(), now())
+    on conflict (name) do nothing
+  `, r.progressTable), name, int64(0))
+	if err != nil {
+		return errors.Wrap(err, "Unable to initialize backfill progress")
+	}
+
+	return runBatches(ctx, name, b.Delay, func() (batchState, error) {
+		var state, next batchState
+		// Serializable isolation makes concurrent runners of the same
+		// backfill conflict instead of processing the same batch twice.
+		// Errors are not wrapped, so that RunInTx can recognize conflicts.
+		err := dbtx.RunInTx(ctx, r.pool, pgx.TxOptions{IsoLevel: pgx.Serializable}, func(tx pgx.Tx) error {
+			var finished *time.Time
+			err := tx.QueryRow(ctx, fmt.Sprintf("select last_key, finished_at from %s where name = $1",
+				r.progressTable), name).Scan(&state.lastKey, &finished)
+			if err != nil {
+				return err
+			}
+			state.finished = finished != nil
+
+			var rows int
+			next, rows, err = nextBatch(ctx, tx, b, batchSize, state)
+			if err != nil || state.finished {
+				return err
+			}
+
+			_, err = tx.Exec(ctx, fmt.Sprintf(`
+        update %s set last_key = $2, rows_done = rows_done + $3, updated_at = now(),
+          finished_at = case when $4 then now() else null end
+        where name = $1
+      `, r.progressTable), name, next.lastKey, int64(rows), next.finished)
+			return err
+		})
+		if err != nil {
+			return state, errors.Wrapf(err, "Backfill %s failed on the batch after key %d", name, state.lastKey)
+		}
+		return next, nil
+	})
+}
+
+// batchState is the progress of a backfill saved after each batch
+type batchState struct {
+	lastKey  int64
+	finished bool
+}
+
+// nextBatch processes the batch following state and returns the state to
+// save along with the batch
+func nextBatch(ctx context.Context, tx pgx.Tx, b Backfill, batchSize int, state batchState) (next batchState,
+	rows int, err error) {
+	if state.finished {
+		return state, 0, nil
+	}
+
+	last, rows, err := b.Batch(ctx, tx, state.lastKey, batchSize)
+	if err != nil {
+		return state, 0, err
+	}
+
+	if rows == 0 {
+		return batchState{lastKey: state.lastKey, finished: true}, 0, nil
+	}
+	return batchState{lastKey: last}, rows, nil
+}
+
+// runBatches calls step, which processes a batch and saves the progress,
+// until the backfill is finished, waiting for delay between the batches
+func runBatches(ctx context.Context, name string, delay time.Duration, step func() (batchState, error)) error {
+	for {
+		state, err := step()
+		if err != nil {
+			return err
+		}
+
+		if state.finished {
+			log.Infof("Backfill %s is complete", name)
+			return nil
+		}
+		log.Debugf("Backfill %s: processed rows up to key %d", name, state.lastKey)
+
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// Status returns the progress of all registered backfills in the order of
+// registration
+func (r *Runner) Status(ctx context.Context) ([]Progress, error) {
+	rows, err := r.pool.Query(ctx, fmt.Sprintf(
+		"select name, last_key, rows_done, started_at, updated_at, finished_at from %s", r.progressTable))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read backfill progress")
+	}
+	defer rows.Close()
+
+	byName := make(map[string]Progress)
+	for rows.Next() {
+		var p Progress
+		err = rows.Scan(&p.Name, &p.LastKey, &p.Rows, &p.StartedAt, &p.UpdatedAt, &p.FinishedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to read backfill progress")
+		}
+		byName[p.Name] = p
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Unable to read backfill progress")
+	}
+
+	result := make([]Progress, 0, len(r.backfills))
+	for _, b := range r.backfills {
+		p, ok := byName[b.Name]
+		if !ok {
+			p = Progress{Name: b.Name}
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
@@ -0,0 +1,138 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// fakeTable is a table with keys 1..rows and a saved progress, where each
+// batch is committed along with the progress or not at all
+type fakeTable struct {
+	rows      int64
+	processed map[int64]int
+	saved     batchState
+	batches   int
+	// failAfter makes the batch after this key fail once, rolling back its
+	// changes
+	failAfter int64
+}
+
+func (f *fakeTable) batch(ctx context.Context, tx pgx.Tx, after int64, limit int) (int64, int, error) {
+	f.batches++
+	last, rows := after, 0
+	for key := after + 1; key <= f.rows && rows < limit; key++ {
+		last = key
+		rows++
+	}
+
+	if f.failAfter != 0 && after == f.failAfter {
+		f.failAfter = 0
+		return 0, 0, errors.New("batch failed")
+	}
+
+	for key := after + 1; key <= last; key++ {
+		f.processed[key]++
+	}
+	return last, rows, nil
+}
+
+func (f *fakeTable) run(ctx context.Context, delay time.Duration) error {
+	b := Backfill{Name: "fake", Batch: f.batch}
+	return runBatches(ctx, b.Name, delay, func() (batchState, error) {
+		next, _, err := nextBatch(ctx, nil, b, 10, f.saved)
+		if err != nil {
+			return f.saved, err
+		}
+		f.saved = next
+		return next, nil
+	})
+}
+
+func (f *fakeTable) requireProcessedOnce(t *testing.T) {
+	require.Len(t, f.processed, int(f.rows))
+	for key, n := range f.processed {
+		require.Equal(t, 1, n, "key %d", key)
+	}
+}
+
+func TestRunBatches(t *testing.T) {
+	t.Parallel()
+
+	f := &fakeTable{rows: 25, processed: make(map[int64]int)}
+	err := f.run(context.Background(), 0)
+	require.NoError(t, err)
+	f.requireProcessedOnce(t)
+	require.Equal(t, batchState{lastKey: 25, finished: true}, f.saved)
+	// Three batches with rows and an empty one
+	require.Equal(t, 4, f.batches)
+
+	// A finished backfill doesn't process anything
+	err = f.run(context.Background(), 0)
+	require.NoError(t, err)
+	require.Equal(t, 4, f.batches)
+}
+
+func TestRunBatchesResume(t *testing.T) {
+	t.Parallel()
+
+	f := &fakeTable{rows: 25, processed: make(map[int64]int), failAfter: 10}
+	err := f.run(context.Background(), 0)
+	require.Error(t, err)
+	// The progress of the failed batch isn't saved
+	require.Equal(t, batchState{lastKey: 10}, f.saved)
+	require.Len(t, f.processed, 10)
+
+	err = f.run(context.Background(), 0)
+	require.NoError(t, err)
+	f.requireProcessedOnce(t)
+	require.Equal(t, batchState{lastKey: 25, finished: true}, f.saved)
+}
+
+func TestRunBatchesCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &fakeTable{rows: 25, processed: make(map[int64]int)}
+	cancel()
+
+	// The first batch is committed, the delay before the next one is
+	// interrupted
+	err := f.run(ctx, time.Hour)
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, batchState{lastKey: 10}, f.saved)
+	require.Equal(t, 1, f.batches)
+
+	err = f.run(context.Background(), 0)
+	require.NoError(t, err)
+	f.requireProcessedOnce(t)
+}
+
+func TestNextBatch(t *testing.T) {
+	t.Parallel()
+
+	var calls int
+	b := Backfill{Name: "fake", Batch: func(ctx context.Context, tx pgx.Tx, after int64, limit int) (int64, int, error) {
+		calls++
+		require.Equal(t, int64(7), after)
+		require.Equal(t, 5, limit)
+		return 0, 0, nil
+	}}
+
+	// No rows after the key finish the backfill, keeping the key
+	next, rows, err := nextBatch(context.Background(), nil, b, 5, batchState{lastKey: 7})
+	require.NoError(t, err)
+	require.Equal(t, 0, rows)
+	require.Equal(t, batchState{lastKey: 7, finished: true}, next)
+	require.Equal(t, 1, calls)
+
+	// The batch function isn't called for a finished backfill
+	next, rows, err = nextBatch(context.Background(), nil, b, 5, next)
+	require.NoError(t, err)
+	require.Equal(t, 0, rows)
+	require.Equal(t, batchState{lastKey: 7, finished: true}, next)
+	require.Equal(t, 1, calls)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/backfill"
+	"github.com/afiskon/go-rest-service-example/migrations"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// newBackfillCmd creates the `migrate backfill` command for the data
+// migrations which are too large to be executed by the migrator
+func newBackfillCmd(configPath *string) *cobra.Command {
+	backfillCmd := &cobra.Command{
+		Use:   "backfill",
+		Short: "Manage batched data migrations",
+	}
+
+	var batchSize int
+	var delay time.Duration
+	withRunner := func(fn func(ctx context.Context, cmd *cobra.Command, r *backfill.Runner) error) func(
+		*cobra.Command, []string) error {
+		return withBackfillRunner(configPath, &batchSize, &delay, fn)
+	}
+
+	backfillCmd.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "Show progress of the backfills",
+		Args:  cobra.NoArgs,
+		RunE: withRunner(func(ctx context.Context, cmd *cobra.Command, r *backfill.Runner) error {
+			progress, err := r.Status(ctx)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tSTATE\tROWS\tLAST KEY\tSTARTED AT\tUPDATED AT")
+			for _, p := range progress {
+				state := "pending"
+				startedAt, updatedAt := "-", "-"
+				if p.StartedAt != nil {
+					state = "in progress"
+					startedAt = p.StartedAt.Format("2006-01-02 15:04:05")
+					updatedAt = p.UpdatedAt.Format("2006-01-02 15:04:05")
+				}
+				if p.FinishedAt != nil {
+					state = "done"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", p.Name, state, p.Rows, p.LastKey, startedAt, updatedAt)
+			}
+			return w.Flush()
+		}),
+	})
+
+	runCmd := &cobra.Command{
+		Use:   "run <name>",
+		Short: "Run or resume a backfill",
+		Args:  cobra.ExactArgs(1),
+		RunE: withRunner(func(ctx context.Context, cmd *cobra.Command, r *backfill.Runner) error {
+			// Interrupted backfill is resumed by the next run
+			ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return r.Run(ctx, cmd.Flags().Arg(0))
+		}),
+	}
+	runCmd.Flags().IntVar(&batchSize, "batch-size", 0, "Rows per transaction, overrides the backfill's default")
+	runCmd.Flags().DurationVar(&delay, "delay", 0, "Pause between batches, overrides the backfill's default")
+	backfillCmd.AddCommand(runCmd)
+
+	return backfillCmd
+}
+
+// withBackfillRunner connects to the database described by the config and
+// passes a runner with all the backfills registered to fn. Non-zero batchSize
+// and delay override the defaults of the backfills.
+func withBackfillRunner(configPath *string, batchSize *int, delay *time.Duration,
+	fn func(ctx context.Context, cmd *cobra.Command, r *backfill.Runner) error) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		initLogging(*configPath)
+
+		ctx := context.Background()
+		pool, err := pgxpool.Connect(ctx, viper.GetString("db.url"))
+		if err != nil {
+			return errors.Wrap(err, "Unable to connect to database")
+		}
+		defer pool.Close()
+
+		r, err := backfill.NewRunner(ctx, pool, backfillProgressTable)
+		if err != nil {
+			return err
+		}
+
+		for _, b := range migrations.Backfills {
+			if *batchSize > 0 {
+				b.BatchSize = *batchSize
+			}
+			if *delay > 0 {
+				b.Delay = *delay
+			}
+			err = r.Register(b)
+			if err != nil {
+				return err
+			}
+		}
+
+		return fn(ctx, cmd, r)
+	}
+}
@@ -0,0 +1,82 @@
+package dberror
+
+// Translation of PostgreSQL / CockroachDB errors into HTTP problems.
+// Both DBMS report errors using the same SQLSTATE codes, see
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+
+import (
+	"errors"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/problem"
+	"github.com/jackc/pgconn"
+	"strings"
+)
+
+const (
+	StringDataRightTruncation = "22001"
+	NotNullViolation          = "23502"
+	ForeignKeyViolation       = "23503"
+	UniqueViolation           = "23505"
+	CheckViolation            = "23514"
+	SerializationFailure      = "40001"
+	DeadlockDetected          = "40P01"
+	QueryCanceled             = "57014"
+)
+
+var (
+	InvalidValue = problem.Type{URI: "/problems/invalid-value", Title: "Invalid value", Status: 422}
+	Conflict     = problem.Type{URI: "/problems/conflict", Title: "Conflicting data", Status: 409}
+	Unavailable  = problem.Type{URI: "/problems/unavailable", Title: "Service temporarily unavailable", Status: 503}
+	Timeout      = problem.Type{URI: "/problems/timeout", Title: "Database timeout", Status: 504}
+)
+
+// Code returns SQLSTATE of the error or an empty string if the error
+// was not reported by the DBMS.
+func Code(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// IsRetryable reports whether the transaction failed because of a conflict
+// with a concurrent one and can be safely retried. CockroachDB returns
+// serialization failures much more often than PostgreSQL does.
+func IsRetryable(err error) bool {
+	code := Code(err)
+	return code == SerializationFailure || code == DeadlockDetected
+}
+
+// Problem translates an error returned by pgx into a problem. Errors which
+// are not caused by the request itself are reported as internal ones.
+func Problem(err error) *problem.Problem {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return problem.New(problem.Internal, "Unable to query the database")
+	}
+
+	var p *problem.Problem
+	switch {
+	case pgErr.Code == UniqueViolation || pgErr.Code == ForeignKeyViolation:
+		p = problem.New(Conflict, pgErr.Message)
+	case pgErr.Code == NotNullViolation || pgErr.Code == CheckViolation:
+		p = problem.New(InvalidValue, pgErr.Message)
+	case strings.HasPrefix(pgErr.Code, "22"): // data exceptions, e.g. StringDataRightTruncation
+		p = problem.New(InvalidValue, pgErr.Message)
+	case IsRetryable(err):
+		p = problem.New(Unavailable, "Too much contention, please retry later")
+	case pgErr.Code == QueryCanceled:
+		p = problem.New(Timeout, "The query took too long")
+	default:
+		return problem.New(problem.Internal, "Unable to query the database")
+	}
+
+	p.With("sqlstate", pgErr.Code)
+	if pgErr.ColumnName != "" {
+		p.With("column", pgErr.ColumnName)
+	}
+	if pgErr.ConstraintName != "" {
+		p.With("constraint", pgErr.ConstraintName)
+	}
+	return p
+}
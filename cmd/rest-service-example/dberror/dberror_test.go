@@ -0,0 +1,41 @@
+package dberror
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestProblem(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		err       error
+		status    int
+		retryable bool
+	}{
+		{&pgconn.PgError{Code: StringDataRightTruncation, Message: "value too long"}, 422, false},
+		{&pgconn.PgError{Code: "22P02", Message: "invalid input syntax"}, 422, false},
+		{&pgconn.PgError{Code: NotNullViolation}, 422, false},
+		{&pgconn.PgError{Code: UniqueViolation, ConstraintName: "phonebook_pkey"}, 409, false},
+		{&pgconn.PgError{Code: ForeignKeyViolation}, 409, false},
+		{&pgconn.PgError{Code: SerializationFailure}, 503, true},
+		{&pgconn.PgError{Code: DeadlockDetected}, 503, true},
+		{&pgconn.PgError{Code: QueryCanceled}, 504, false},
+		{&pgconn.PgError{Code: "42P01", Message: "relation does not exist"}, 500, false},
+		{fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: SerializationFailure}), 503, true},
+		{errors.New("connection reset by peer"), 500, false},
+	}
+
+	for _, c := range cases {
+		p := Problem(c.err)
+		require.Equal(t, c.status, p.Status, c.err.Error())
+		require.Equal(t, c.retryable, IsRetryable(c.err), c.err.Error())
+	}
+
+	p := Problem(&pgconn.PgError{Code: UniqueViolation, ConstraintName: "phonebook_pkey"})
+	require.Equal(t, UniqueViolation, p.Extensions["sqlstate"])
+	require.Equal(t, "phonebook_pkey", p.Extensions["constraint"])
+}
@@ -0,0 +1,83 @@
+package dbtx
+
+import (
+	"context"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/dberror"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxAttempts = 5
+	baseDelay   = 10 * time.Millisecond
+	maxDelay    = 500 * time.Millisecond
+)
+
+// Total number of retries since the process start, see Retries()
+var retries int64
+
+// Retries returns the total number of transactions retried by RunInTx
+func Retries() int64 {
+	return atomic.LoadInt64(&retries)
+}
+
+// RunInTx executes fn in a transaction and commits it. If the transaction
+// fails because of a conflict with a concurrent one (which is a common
+// case on CockroachDB under contention), it is retried with exponential
+// backoff and jitter, up to maxAttempts times in total. fn can be called
+// several times and thus should not have side effects besides the ones
+// made through tx. The last error is returned if all attempts fail.
+func RunInTx(ctx context.Context, pool *pgxpool.Pool, opts pgx.TxOptions, fn func(tx pgx.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := runOnce(ctx, pool, opts, fn)
+		if err == nil || !dberror.IsRetryable(err) || attempt == maxAttempts {
+			if attempt > 1 {
+				log.WithField("tx_retries", attempt-1).Debugf("Transaction finished after retries, err = %v", err)
+			}
+			return err
+		}
+
+		atomic.AddInt64(&retries, 1)
+		delay := backoff(attempt)
+		log.WithField("tx_retries", attempt).Debugf("Transaction failed, retrying in %v: %v", delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func runOnce(ctx context.Context, pool *pgxpool.Pool, opts pgx.TxOptions, fn func(tx pgx.Tx) error) error {
+	tx, err := pool.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	// Rollback has no effect if Commit was called
+	defer tx.Rollback(ctx)
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// backoff returns a random delay between 0 and baseDelay * 2^(attempt-1),
+// capped by maxDelay ("full jitter"). Randomization prevents conflicting
+// transactions from being retried at the same moment over and over again.
+func backoff(attempt int) time.Duration {
+	ceiling := maxDelay
+	if attempt < 16 && baseDelay<<uint(attempt-1) < maxDelay {
+		ceiling = baseDelay << uint(attempt-1)
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
@@ -0,0 +1,23 @@
+package dbtx
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+
+	for attempt := 1; attempt < 100; attempt++ {
+		ceiling := maxDelay
+		if attempt <= 6 {
+			ceiling = baseDelay << uint(attempt-1)
+		}
+
+		for i := 0; i < 100; i++ {
+			delay := backoff(attempt)
+			require.True(t, delay >= 0)
+			require.True(t, delay <= ceiling, "attempt %d: %v > %v", attempt, delay, ceiling)
+		}
+	}
+}
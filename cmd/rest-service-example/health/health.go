@@ -0,0 +1,118 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/migrate"
+	"github.com/jackc/pgx/v4/pgxpool"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+const checkTimeout = 3 * time.Second
+
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+	statusError       = "error"
+	statusBehind      = "behind"
+	statusAhead       = "ahead"
+	statusReadOnly    = "read-only"
+)
+
+type Check struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type SchemaCheck struct {
+	Check
+	Current int32 `json:"current"`
+	Min     int32 `json:"min"`
+	Max     int32 `json:"max"`
+}
+
+type Report struct {
+	Status   string      `json:"status"`
+	Database Check       `json:"database"`
+	Schema   SchemaCheck `json:"schema"`
+}
+
+// Liveness reports that the process is up and able to serve HTTP requests.
+// It doesn't check any dependencies, a failing DB is not a reason to restart.
+func Liveness(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, map[string]string{"status": statusOK})
+}
+
+// Readiness reports whether the service can handle requests: the database
+// is reachable and the schema version is within the range minVersion to
+// maxVersion supported by the binary. A service in the read-only mode was
+// started with an unsupported schema on purpose and is ready to serve reads.
+func Readiness(p *pgxpool.Pool, versionTable string, minVersion, maxVersion int32, readOnly bool, w http.ResponseWriter,
+	r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	report := Report{
+		Status:   statusOK,
+		Database: Check{Status: statusOK},
+		Schema:   SchemaCheck{Check: Check{Status: statusOK}, Min: minVersion, Max: maxVersion},
+	}
+
+	conn, err := p.Acquire(ctx)
+	if err == nil {
+		defer conn.Release()
+		err = conn.Conn().Ping(ctx)
+	}
+
+	if err != nil {
+		log.Warnf("Readiness check: database is unavailable: %v", err)
+		report.Status = statusUnavailable
+		report.Database = Check{Status: statusError, Error: err.Error()}
+		report.Schema.Check = Check{Status: statusError, Error: "database is unavailable"}
+		writeJSON(w, 503, report)
+		return
+	}
+
+	report.Schema.Current, err = migrate.GetVersion(ctx, conn.Conn(), versionTable)
+	if err != nil {
+		log.Warnf("Readiness check: unable to get schema version: %v", err)
+		report.Status = statusUnavailable
+		report.Schema.Check = Check{Status: statusError, Error: err.Error()}
+		writeJSON(w, 503, report)
+		return
+	}
+
+	report.Schema.Status = schemaStatus(report.Schema.Current, minVersion, maxVersion)
+	if readOnly {
+		report.Status = statusReadOnly
+	} else if report.Schema.Status != statusOK {
+		report.Status = statusUnavailable
+		writeJSON(w, 503, report)
+		return
+	}
+
+	writeJSON(w, 200, report)
+}
+
+func schemaStatus(current, minVersion, maxVersion int32) string {
+	if current < minVersion {
+		return statusBehind
+	}
+	if current > maxVersion {
+		return statusAhead
+	}
+	return statusOK
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	// Probes should never be cached by proxies
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Errorf("Unable to encode json: %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+package health
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSchemaStatus(t *testing.T) {
+	t.Parallel()
+
+	// A replica of the new release is ready before the schema is migrated
+	require.Equal(t, statusOK, schemaStatus(2, 2, 3))
+	require.Equal(t, statusOK, schemaStatus(3, 2, 3))
+	require.Equal(t, statusBehind, schemaStatus(1, 2, 3))
+	require.Equal(t, statusAhead, schemaStatus(4, 2, 3))
+}
@@ -2,16 +2,43 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/health"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/metrics"
 	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/records"
 	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/migrate"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/problem"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/requestid"
+	"github.com/afiskon/go-rest-service-example/migrations"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	version               = "v1.0"
+	schemaVersionTable    = "schema_version"
+	backfillProgressTable = "backfill_progress"
+
+	// Variables with this prefix override migrations.data
+	migrationsDataEnvPrefix = "RESTEXAMPLE_MIGRATIONS_DATA_"
+
+	// The oldest schema version this build can work with, the newest one is
+	// the number of bundled migrations. The service refuses to start, or
+	// serves only reads if schema.incompatible is read-only, when the schema
+	// is outside of this range. minSchemaVersion should be raised only when
+	// the code stops working with the older schema.
+	minSchemaVersion int32 = 2
 )
 
 func initViper(configPath string) {
@@ -21,6 +48,16 @@ func initViper(configPath string) {
 
 	viper.SetDefault("loglevel", "debug")
 	viper.SetDefault("listen", "localhost:8080")
+	viper.SetDefault("admin.listen", "localhost:8081")
+	viper.SetDefault("http.request_timeout", "30s")
+	viper.SetDefault("http.shutdown_timeout", "15s")
+	viper.SetDefault("migrations.lock_timeout", "1m")
+	viper.SetDefault("migrations.lock_ttl", "15m")
+	viper.SetDefault("migrations.allow_drift", false)
+	viper.SetDefault("migrations.dir", "")
+	viper.SetDefault("migrations.versioning", "sequential")
+	viper.SetDefault("migrations.allow_out_of_order", false)
+	viper.SetDefault("schema.incompatible", "refuse")
 	viper.SetDefault("db.url", "postgres://restservice@localhost/restservice?sslmode=disable&pool_max_conns=10")
 
 	if configPath != "" {
@@ -35,27 +72,178 @@ func initViper(configPath string) {
 	}
 }
 
-func migrateDatabase(conn *pgx.Conn) {
-	migrator, err := migrate.NewMigrator(conn, "schema_version")
+func initLogging(configPath string) {
+	customFormatter := new(log.TextFormatter)
+	customFormatter.TimestampFormat = "2006-01-02 15:04:05"
+	customFormatter.FullTimestamp = true
+	log.SetFormatter(customFormatter)
+
+	initViper(configPath)
+
+	logLevelString := viper.GetString("loglevel")
+	logLevel, err := log.ParseLevel(logLevelString)
 	if err != nil {
-		log.Fatalf("Unable to create a migrator: %v", err)
+		log.Fatalf("Unable to parse loglevel: %s", logLevelString)
+	}
+
+	log.SetLevel(logLevel)
+}
+
+// migrationsSource returns the filesystem and the path to load migrations
+// from. Migrations embedded into the binary are used unless migrations.dir
+// is set, which is convenient during development.
+func migrationsSource() (migrate.MigratorFS, string) {
+	if dir := viper.GetString("migrations.dir"); dir != "" {
+		return migrate.NewMigratorFS(os.DirFS(dir)), "."
+	}
+	return migrate.NewMigratorFS(migrations.FS), "."
+}
+
+// migrationsVersioning returns the versioning scheme of the migration files
+func migrationsVersioning() (migrate.Versioning, error) {
+	versioning, err := migrate.ParseVersioning(viper.GetString("migrations.versioning"))
+	return versioning, errors.Wrap(err, "Invalid migrations.versioning")
+}
+
+// migrationsData returns the data available to the migration templates:
+// migrations.data from the config file overridden by the environment
+// variables like RESTEXAMPLE_MIGRATIONS_DATA_GRANT_ROLE. Viper lowercases the
+// keys, so do the variables, i.e. the last one is {{.grant_role}}.
+//
+// The checksums of the applied migrations are computed over the rendered SQL,
+// so changing a value used by one of them is reported as a checksum drift.
+// Values which differ between environments or change over time belong to
+// the repeatable migrations, which are re-applied instead.
+func migrationsData() map[string]interface{} {
+	data := make(map[string]interface{})
+	for key, value := range viper.GetStringMap("migrations.data") {
+		data[key] = value
+	}
+
+	for _, env := range os.Environ() {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) == 2 && strings.HasPrefix(kv[0], migrationsDataEnvPrefix) && kv[0] != migrationsDataEnvPrefix {
+			data[strings.ToLower(strings.TrimPrefix(kv[0], migrationsDataEnvPrefix))] = kv[1]
+		}
 	}
+	return data
+}
 
-	err = migrator.LoadMigrations("./migrations")
+// migratorOptions returns the migrator options according to the config file
+// and the path to load migrations from
+func migratorOptions() (*migrate.MigratorOptions, string, error) {
+	migratorFS, migrationsPath := migrationsSource()
+	versioning, err := migrationsVersioning()
 	if err != nil {
-		log.Fatalf("Unable to load migrations: %v", err)
+		return nil, "", err
 	}
 
-	err = migrator.Migrate(func(err error) (retry bool) {
-		log.Infof("Commit failed during migration, retrying. Error: %v", err)
-		return true
-	})
+	opts := &migrate.MigratorOptions{
+		MigratorFS:         migratorFS,
+		LockTimeout:        viper.GetDuration("migrations.lock_timeout"),
+		LockTTL:            viper.GetDuration("migrations.lock_ttl"),
+		AllowChecksumDrift: viper.GetBool("migrations.allow_drift"),
+		Versioning:         versioning,
+		AllowOutOfOrder:    viper.GetBool("migrations.allow_out_of_order"),
+	}
+	return opts, migrationsPath, nil
+}
 
+// loadMigrations registers the Go migrations and loads the files rendered
+// for the given DBMS
+func loadMigrations(migrator *migrate.Migrator, migrationsPath string, cockroachDB bool) error {
+	for key, value := range migrationsData() {
+		migrator.Data[key] = value
+	}
+	// Migrations can use {{if .CockroachDB}} for DBMS-specific parts
+	migrator.Data["CockroachDB"] = cockroachDB
+
+	for _, g := range migrations.Go {
+		err := migrator.RegisterGoMigration(g)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := migrator.LoadMigrations(migrationsPath)
+	if err != nil {
+		return errors.Wrap(err, "Unable to load migrations")
+	}
+	return nil
+}
+
+// newMigrator creates a migrator configured according to the config file and
+// loads the migrations. conn is used for migrating, the lock is renewed using
+// another connection from the pool.
+func newMigrator(ctx context.Context, pool *pgxpool.Pool, conn *pgx.Conn, cockroachDB bool) (*migrate.Migrator, error) {
+	opts, migrationsPath, err := migratorOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts.AcquireLockConn = func(ctx context.Context) (*pgx.Conn, func(), error) {
+		c, err := pool.Acquire(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return c.Conn(), c.Release, nil
+	}
+
+	migrator, err := migrate.NewMigratorEx(ctx, conn, schemaVersionTable, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create a migrator")
+	}
+
+	migrator.OnStart = func(sequence int32, name, direction, sql string) {
+		log.Infof("Migrating %s: %s", direction, name)
+	}
+	migrator.OnChecksumMismatch = func(err migrate.ChecksumMismatchError) {
+		log.Warnf("%v", err)
+	}
+
+	err = loadMigrations(migrator, migrationsPath, cockroachDB)
+	if err != nil {
+		return nil, err
+	}
+	return migrator, nil
+}
+
+// newReadOnlyMigrator creates a migrator which doesn't change the database,
+// i.e. doesn't create its tables if they don't exist yet
+func newReadOnlyMigrator(ctx context.Context, conn *pgx.Conn, cockroachDB bool) (*migrate.Migrator, error) {
+	opts, migrationsPath, err := migratorOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	migrator, err := migrate.NewReadOnlyMigrator(ctx, conn, schemaVersionTable, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create a migrator")
+	}
+
+	err = loadMigrations(migrator, migrationsPath, cockroachDB)
+	if err != nil {
+		return nil, err
+	}
+	return migrator, nil
+}
+
+func migrateDatabase(ctx context.Context, pool *pgxpool.Pool, conn *pgx.Conn, cockroachDB bool) {
+	migrator, err := newMigrator(ctx, pool, conn, cockroachDB)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	err = migrator.Migrate(ctx, retryOnCommitFailure)
+	if tooNew, ok := err.(migrate.SchemaTooNewError); ok {
+		// Left for checkSchemaVersion, the schema is not rolled back
+		log.Warnf("%v, not migrating", tooNew)
+		return
+	}
 	if err != nil {
 		log.Fatalf("Unable to migrate: %v", err)
 	}
 
-	ver, err := migrator.GetCurrentVersion()
+	ver, err := migrator.GetCurrentVersion(ctx)
 	if err != nil {
 		log.Fatalf("Unable to get current schema version: %v", err)
 	}
@@ -63,13 +251,78 @@ func migrateDatabase(conn *pgx.Conn) {
 	log.Infof("Migration done. Current schema version: %v", ver)
 }
 
-func initHandlers(pool *pgxpool.Pool) http.Handler {
+// withRequestTimeout limits the time a handler can spend on a request.
+// Handlers pass the request context to all DB calls, so queries are
+// canceled once the deadline is exceeded.
+func withRequestTimeout(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// rejectWrites allows only the requests which don't modify data
+func rejectWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" {
+			problem.Write(w, r, problem.ReadOnly, "The database schema is not compatible with this version")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkSchemaVersion makes sure the schema is within the range of versions
+// this build supports, maxSchemaVersion is the number of bundled migrations.
+// It returns true if only reads should be served.
+func checkSchemaVersion(ctx context.Context, conn *pgx.Conn, maxSchemaVersion int32) (readOnly bool, err error) {
+	schemaVersion, err := migrate.GetVersion(ctx, conn, schemaVersionTable)
+	if err != nil {
+		return false, errors.Wrap(err, "Unable to get current schema version")
+	}
+
+	if schemaVersion >= minSchemaVersion && schemaVersion <= maxSchemaVersion {
+		return false, nil
+	}
+
+	msg := fmt.Sprintf("Schema version %d is outside of the versions %d to %d supported by %s",
+		schemaVersion, minSchemaVersion, maxSchemaVersion, version)
+	switch mode := viper.GetString("schema.incompatible"); mode {
+	case "refuse":
+		return false, errors.New(msg)
+	case "read-only":
+		log.Warnf("%s, serving only reads", msg)
+		return true, nil
+	default:
+		return false, errors.Errorf("Invalid schema.incompatible: %s", mode)
+	}
+}
+
+func initHandlers(pool *pgxpool.Pool, cockroachDB bool, requestTimeout time.Duration, schemaVersion int32,
+	readOnly bool, reg *metrics.Registry) http.Handler {
 	r := mux.NewRouter()
+	r.Use(reg.Middleware)
+	if readOnly {
+		r.Use(rejectWrites)
+	}
+	r.HandleFunc("/healthz", health.Liveness).Methods("GET")
+
+	r.HandleFunc("/readyz",
+		func(w http.ResponseWriter, r *http.Request) {
+			health.Readiness(pool, schemaVersionTable, minSchemaVersion, schemaVersion, readOnly, w, r)
+		}).Methods("GET")
+
 	r.HandleFunc("/api/v1/records",
 		func(w http.ResponseWriter, r *http.Request) {
 			records.SelectAll(pool, w, r)
 		}).Methods("GET")
 
+	r.HandleFunc("/api/v1/records/search",
+		func(w http.ResponseWriter, r *http.Request) {
+			records.Search(pool, cockroachDB, w, r)
+		}).Methods("GET")
+
 	r.HandleFunc("/api/v1/records/{id:[0-9]+}",
 		func(w http.ResponseWriter, r *http.Request) {
 			records.Select(pool, w, r)
@@ -89,50 +342,131 @@ func initHandlers(pool *pgxpool.Pool) http.Handler {
 		func(w http.ResponseWriter, r *http.Request) {
 			records.Delete(pool, w, r)
 		}).Methods("DELETE")
+
+	// Middlewares are not applied to these handlers by the router
+	r.NotFoundHandler = reg.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		problem.Write(w, r, problem.NotFound, "")
+	}))
+	r.MethodNotAllowedHandler = reg.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		problem.Write(w, r, problem.MethodNotAllowed, "")
+	}))
+	return requestid.Middleware(withRequestTimeout(requestTimeout, r))
+}
+
+// initAdminHandlers creates handlers for the admin listener, which is
+// not supposed to be exposed to the clients of the service.
+func initAdminHandlers(pool *pgxpool.Pool, reg *metrics.Registry) http.Handler {
+	reg.Register(metrics.BuildInfo(version))
+	reg.Register(metrics.PoolStats(pool))
+	reg.Register(metrics.TxRetries())
+	reg.Register(metrics.SchemaVersion(pool, schemaVersionTable))
+
+	r := mux.NewRouter()
+	r.Handle("/metrics", reg.Handler()).Methods("GET")
 	return r
 }
 
 func run(configPath string, skipMigration bool) {
-	customFormatter := new(log.TextFormatter)
-	customFormatter.TimestampFormat = "2006-01-02 15:04:05"
-	customFormatter.FullTimestamp = true
-	log.SetFormatter(customFormatter)
+	initLogging(configPath)
 
-	initViper(configPath)
+	dbURL := viper.GetString("db.url")
+	log.Infof("Using DB URL: %s", dbURL)
 
-	logLevelString := viper.GetString("loglevel")
-	logLevel, err := log.ParseLevel(logLevelString)
-	if err != nil {
-		log.Fatalf("Unable to parse loglevel: %s", logLevelString)
+	requestTimeout := viper.GetDuration("http.request_timeout")
+	if requestTimeout <= 0 {
+		log.Fatalf("Invalid http.request_timeout: %s", viper.GetString("http.request_timeout"))
 	}
 
-	log.SetLevel(logLevel)
-
-	dbURL := viper.GetString("db.url")
-	log.Infof("Using DB URL: %s", dbURL)
+	shutdownTimeout := viper.GetDuration("http.shutdown_timeout")
+	if shutdownTimeout <= 0 {
+		log.Fatalf("Invalid http.shutdown_timeout: %s", viper.GetString("http.shutdown_timeout"))
+	}
 
-	pool, err := pgxpool.Connect(context.Background(), dbURL)
+	ctx := context.Background()
+	pool, err := pgxpool.Connect(ctx, dbURL)
 	if err != nil {
 		log.Fatalf("Unable to connection to database: %v", err)
 	}
-	defer pool.Close()
 	log.Infof("Connected!")
 
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		log.Fatalf("Unable to acquire a database connection: %v", err)
+	}
+	cockroachDB, err := migrate.IsCockroachDB(ctx, conn.Conn())
+	if err != nil {
+		log.Fatalf("Unable to get DBMS version: %v", err)
+	}
+
+	// The schema is expected to be at least as new as the bundled migrations
+	// and it's the newest version this build supports
+	migratorFS, migrationsPath := migrationsSource()
+	versioning, err := migrationsVersioning()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	schemaVersion, err := migrate.CountMigrations(migrationsPath, migratorFS, versioning, migrations.Go)
+	if err != nil {
+		log.Fatalf("Unable to find migrations: %v", err)
+	}
+
 	if !skipMigration {
-		conn, err := pool.Acquire(context.Background())
-		if err != nil {
-			log.Fatalf("Unable to acquire a database connection: %v", err)
-		}
-		migrateDatabase(conn.Conn())
-		conn.Release()
+		migrateDatabase(ctx, pool, conn.Conn(), cockroachDB)
+	}
+	readOnly, err := checkSchemaVersion(ctx, conn.Conn(), schemaVersion)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
+	conn.Release()
 
+	reg := metrics.NewRegistry()
 	listenAddr := viper.GetString("listen")
 	log.Infof("Starting HTTP server at %s...", listenAddr)
-	http.Handle("/", initHandlers(pool))
-	err = http.ListenAndServe(listenAddr, nil)
-	if err != nil {
+	server := &http.Server{
+		Addr:    listenAddr,
+		Handler: initHandlers(pool, cockroachDB, requestTimeout, schemaVersion, readOnly, reg),
+	}
+
+	adminListenAddr := viper.GetString("admin.listen")
+	log.Infof("Starting admin HTTP server at %s...", adminListenAddr)
+	adminServer := &http.Server{
+		Addr:    adminListenAddr,
+		Handler: initAdminHandlers(pool, reg),
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	serverErr := make(chan error, 2)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	go func() {
+		serverErr <- adminServer.ListenAndServe()
+	}()
+
+	select {
+	case err = <-serverErr:
 		log.Fatalf("http.ListenAndServe: %v", err)
+	case sig := <-stop:
+		log.Infof("Received %v, draining connections (timeout: %v)...", sig, shutdownTimeout)
+	}
+
+	// Shutdown stops accepting new connections and waits for the in-flight
+	// requests to complete. The pool should be closed only after that.
+	// The admin server is stopped last to keep metrics available during
+	// the drain.
+	shutdownCtx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	err = server.Shutdown(shutdownCtx)
+	adminErr := adminServer.Shutdown(shutdownCtx)
+	cancel()
+	pool.Close()
+	if err == nil {
+		err = adminErr
+	}
+	if err != nil {
+		log.Errorf("Unable to drain connections: %v", err)
+		os.Exit(1)
 	}
 
 	log.Info("HTTP server terminated")
@@ -144,17 +478,21 @@ func main() {
 
 	rootCmd := cobra.Command{
 		Use:     "rest-service-example",
-		Version: "v1.0",
+		Version: version,
 		Run: func(cmd *cobra.Command, args []string) {
 			run(configPath, skipMigration)
 		},
 	}
 
-	rootCmd.Flags().StringVarP(&configPath, "config", "c", "", "Config file path")
+	rootCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "", "Config file path")
+	rootCmd.PersistentFlags().String("migrations-dir", "",
+		"Load migrations from a directory instead of the ones embedded into the binary")
+	_ = viper.BindPFlag("migrations.dir", rootCmd.PersistentFlags().Lookup("migrations-dir"))
 	rootCmd.Flags().BoolVarP(&skipMigration, "skip-migration", "s", false, "Skip migration")
+	rootCmd.AddCommand(newMigrateCmd(&configPath))
 	err := rootCmd.Execute()
 	if err != nil {
-		// Required arguments are missing, etc
-		return
+		// Required arguments are missing, migration failed, etc
+		os.Exit(1)
 	}
 }
@@ -4,15 +4,23 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/backfill"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/migrate"
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/ory/dockertest/v3"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"text/template"
@@ -47,6 +55,16 @@ func (client *httpClient) sendJsonReq(method, url string, reqBody []byte) (resp
 	return resp, resBody, nil
 }
 
+// Connection string of the DBMS started by TestMain, for tests which need
+// to access the database directly
+var testDBConnString string
+
+// Config of the service started by TestMain, for running CLI commands
+var testConfPath string
+
+// The binary is built by build.sh
+const binaryPath = "../../bin/rest-service-example"
+
 func waitForDBMSAndCreateConfig(pool *dockertest.Pool, resource *dockertest.Resource, connString string) (confPath string, cleaner func()) {
 	// DBMS needs some time to start.
 	// Port forwarding always works, thus net.Dial can't be used here.
@@ -70,6 +88,7 @@ func waitForDBMSAndCreateConfig(pool *dockertest.Pool, resource *dockertest.Reso
 		_ = pool.Purge(resource)
 		log.Panicf("[waitForDBMSAndCreateConfig] couldn't connect to PostgreSQL")
 	}
+	testDBConnString = connString
 
 	tmpl, err := template.New("config").Parse(`
 loglevel: debug
@@ -187,17 +206,13 @@ func TestMain(m *testing.M) {
 		log.Infoln("[TestMain] PostgreSQL started!")
 	}
 
-	// We should change directory, otherwise the service will not find `migrations` directory
-	err := os.Chdir("../..")
-	if err != nil {
-		stopDB()
-		log.Panicf("[TestMain] os.Chdir failed: %v", err)
-	}
+	testConfPath = confPath
 
-	cmd := exec.Command("./bin/rest-service-example", "-c", confPath)
+	// Migrations are embedded into the binary, so it can be started from any directory
+	cmd := exec.Command(binaryPath, "-c", confPath)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	err = cmd.Start()
+	err := cmd.Start()
 	if err != nil {
 		stopDB()
 		log.Panicf("[TestMain] cmd.Start failed: %v", err)
@@ -212,13 +227,19 @@ func TestMain(m *testing.M) {
 	client := httpClient{}
 	for attempt < 20 {
 		attempt++
-		_, _, err := client.sendJsonReq("GET", "http://localhost:8080/api/v1/records/0", []byte{})
+		resp, _, err := client.sendJsonReq("GET", "http://localhost:8080/readyz", []byte{})
 		if err != nil {
 			log.Infof("[TestMain] client.sendJsonReq failed: %v, waiting... (attempt %d)", err, attempt)
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
+		if resp.StatusCode != 200 {
+			log.Infof("[TestMain] /readyz returned %d, waiting... (attempt %d)", resp.StatusCode, attempt)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
 		ok = true
 		break
 	}
@@ -234,7 +255,30 @@ func TestMain(m *testing.M) {
 	code := m.Run()
 
 	log.Infoln("[TestMain] Cleaning up...")
-	_ = cmd.Process.Signal(syscall.SIGTERM)
+	// The service is expected to drain connections and exit with zero code
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	err = cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		log.Errorf("[TestMain] cmd.Process.Signal failed: %v", err)
+		code = 1
+	}
+
+	select {
+	case err = <-exited:
+		if err != nil {
+			log.Errorf("[TestMain] the service terminated abnormally: %v", err)
+			code = 1
+		}
+	case <-time.After(30 * time.Second):
+		log.Errorf("[TestMain] the service didn't terminate after SIGTERM")
+		_ = cmd.Process.Kill()
+		code = 1
+	}
+
 	stopDB()
 	os.Exit(code)
 }
@@ -300,4 +344,1194 @@ func TestCRUD(t *testing.T) {
 	resp, respBody, err = client.sendJsonReq("GET", "http://localhost:8080/api/v1/records/"+respBodyMap["id"], []byte{})
 	require.NoError(t, err)
 	require.Equal(t, 404, resp.StatusCode)
+	require.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+	problemBody := make(map[string]interface{})
+	err = json.Unmarshal(respBody, &problemBody)
+	require.NoError(t, err)
+	require.Equal(t, "/problems/not-found", problemBody["type"])
+	require.Equal(t, "/api/v1/records/"+respBodyMap["id"], problemBody["instance"])
+	require.Equal(t, resp.Header.Get("X-Request-Id"), problemBody["request_id"])
+	require.NotEmpty(t, problemBody["request_id"])
+}
+
+func TestList(t *testing.T) {
+	t.Parallel()
+
+	type PhonebookRecord struct {
+		Id int64 `json:"id"`
+		Name string `json:"name"`
+		Phone string `json:"phone"`
+	}
+	type PhonebookPage struct {
+		Records []PhonebookRecord `json:"records"`
+		Next string `json:"next"`
+	}
+	client := httpClient{}
+
+	// CREATE a few records to make sure there is more than one page
+	created := make(map[int64]bool)
+	for i := 0; i < 5; i++ {
+		record := PhonebookRecord{
+			Name:  "Page " + strconv.Itoa(i),
+			Phone: "789",
+		}
+		httpBody, err := json.Marshal(record)
+		require.NoError(t, err)
+		resp, respBody, err := client.sendJsonReq("POST", "http://localhost:8080/api/v1/records", httpBody)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		respBodyMap := make(map[string]string, 1)
+		err = json.Unmarshal(respBody, &respBodyMap)
+		require.NoError(t, err)
+		recId, err := strconv.ParseInt(respBodyMap["id"], 10, 63)
+		require.NoError(t, err)
+		created[recId] = true
+	}
+
+	// Walk all the pages and make sure ids are strictly increasing
+	found := 0
+	lastId := int64(0)
+	pages := 0
+	next := "/api/v1/records?limit=2"
+	for next != "" {
+		resp, respBody, err := client.sendJsonReq("GET", "http://localhost:8080"+next, []byte{})
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		var page PhonebookPage
+		err = json.Unmarshal(respBody, &page)
+		require.NoError(t, err)
+		require.True(t, len(page.Records) <= 2)
+
+		for _, rec := range page.Records {
+			require.True(t, rec.Id > lastId)
+			lastId = rec.Id
+			if created[rec.Id] {
+				found++
+			}
+		}
+
+		pages++
+		next = page.Next
+	}
+
+	require.Equal(t, len(created), found)
+	require.True(t, pages >= 3)
+
+	// Malformed limit and cursor are rejected
+	resp, _, err := client.sendJsonReq("GET", "http://localhost:8080/api/v1/records?limit=0", []byte{})
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode)
+	resp, _, err = client.sendJsonReq("GET", "http://localhost:8080/api/v1/records?after=not-a-cursor", []byte{})
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode)
+}
+
+func TestFilter(t *testing.T) {
+	t.Parallel()
+
+	type PhonebookRecord struct {
+		Id int64 `json:"id"`
+		Name string `json:"name"`
+		Phone string `json:"phone"`
+	}
+	type PhonebookPage struct {
+		Records []PhonebookRecord `json:"records"`
+		Next string `json:"next"`
+	}
+	client := httpClient{}
+
+	for _, record := range []PhonebookRecord{
+		{Name: "Filterina Smith", Phone: "+7-111"},
+		{Name: "filterina jones", Phone: "+1-222"},
+		{Name: "Filterino", Phone: "+7-333"},
+	} {
+		httpBody, err := json.Marshal(record)
+		require.NoError(t, err)
+		resp, _, err := client.sendJsonReq("POST", "http://localhost:8080/api/v1/records", httpBody)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+	}
+
+	query := func(filter string) (int, []PhonebookRecord) {
+		resp, respBody, err := client.sendJsonReq("GET", "http://localhost:8080/api/v1/records?"+url.Values{"filter": {filter}}.Encode(), []byte{})
+		require.NoError(t, err)
+		if resp.StatusCode != 200 {
+			return resp.StatusCode, nil
+		}
+		var page PhonebookPage
+		err = json.Unmarshal(respBody, &page)
+		require.NoError(t, err)
+		return resp.StatusCode, page.Records
+	}
+
+	code, recs := query(`name~"FILTERINA"`)
+	require.Equal(t, 200, code)
+	require.Equal(t, 2, len(recs))
+
+	code, recs = query(`name~"filterin" and phone^="+7"`)
+	require.Equal(t, 200, code)
+	require.Equal(t, 2, len(recs))
+
+	code, recs = query(`name="Filterino" or phone="+1-222"`)
+	require.Equal(t, 200, code)
+	require.Equal(t, 2, len(recs))
+
+	code, recs = query(`name^="Filterina" and phone^="+1"`)
+	require.Equal(t, 200, code)
+	require.Equal(t, 0, len(recs))
+
+	// Malformed expression
+	resp, respBody, err := client.sendJsonReq("GET", "http://localhost:8080/api/v1/records?"+url.Values{"filter": {`name~"x" and email="y"`}}.Encode(), []byte{})
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode)
+	respBodyMap := make(map[string]interface{})
+	err = json.Unmarshal(respBody, &respBodyMap)
+	require.NoError(t, err)
+	require.Equal(t, float64(13), respBodyMap["offset"])
+	require.Equal(t, "email", respBodyMap["token"])
+}
+
+func TestSearch(t *testing.T) {
+	t.Parallel()
+
+	type PhonebookRecord struct {
+		Id int64 `json:"id"`
+		Name string `json:"name"`
+		Phone string `json:"phone"`
+	}
+	type SearchResult struct {
+		Record PhonebookRecord `json:"record"`
+		Score float64 `json:"score"`
+	}
+	type SearchResults struct {
+		Results []SearchResult `json:"results"`
+	}
+	client := httpClient{}
+
+	record := PhonebookRecord{
+		Name:  "Zyxwvut",
+		Phone: "321",
+	}
+	httpBody, err := json.Marshal(record)
+	require.NoError(t, err)
+	resp, respBody, err := client.sendJsonReq("POST", "http://localhost:8080/api/v1/records", httpBody)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	respBodyMap := make(map[string]string, 1)
+	err = json.Unmarshal(respBody, &respBodyMap)
+	require.NoError(t, err)
+	recId, err := strconv.ParseInt(respBodyMap["id"], 10, 63)
+	require.NoError(t, err)
+
+	// A typo should still find the record
+	resp, respBody, err = client.sendJsonReq("GET", "http://localhost:8080/api/v1/records/search?q=Zyxwuvt", []byte{})
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	var results SearchResults
+	err = json.Unmarshal(respBody, &results)
+	require.NoError(t, err)
+	require.NotEmpty(t, results.Results)
+	require.Equal(t, recId, results.Results[0].Record.Id)
+	require.Equal(t, "Zyxwvut", results.Results[0].Record.Name)
+	require.InDelta(t, 4.0/12.0, results.Results[0].Score, 1e-6)
+
+	// Empty query is a bad request
+	resp, _, err = client.sendJsonReq("GET", "http://localhost:8080/api/v1/records/search?q=", []byte{})
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode)
+}
+
+func TestInvalidValue(t *testing.T) {
+	t.Parallel()
+
+	type PhonebookRecord struct {
+		Name string `json:"name"`
+		Phone string `json:"phone"`
+	}
+	client := httpClient{}
+
+	// phonebook.name is VARCHAR(64)
+	record := PhonebookRecord{
+		Name:  strings.Repeat("x", 65),
+		Phone: "123",
+	}
+	httpBody, err := json.Marshal(record)
+	require.NoError(t, err)
+	resp, respBody, err := client.sendJsonReq("POST", "http://localhost:8080/api/v1/records", httpBody)
+	require.NoError(t, err)
+	require.Equal(t, 422, resp.StatusCode)
+	problemBody := make(map[string]interface{})
+	err = json.Unmarshal(respBody, &problemBody)
+	require.NoError(t, err)
+	require.Equal(t, "/problems/invalid-value", problemBody["type"])
+	require.Equal(t, "22001", problemBody["sqlstate"])
+	require.NotEmpty(t, problemBody["detail"])
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	t.Parallel()
+
+	type PhonebookRecord struct {
+		Name string `json:"name"`
+		Phone string `json:"phone"`
+	}
+	client := httpClient{}
+
+	httpBody, err := json.Marshal(PhonebookRecord{Name: "Contended", Phone: "0"})
+	require.NoError(t, err)
+	resp, respBody, err := client.sendJsonReq("POST", "http://localhost:8080/api/v1/records", httpBody)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	respBodyMap := make(map[string]string, 1)
+	err = json.Unmarshal(respBody, &respBodyMap)
+	require.NoError(t, err)
+
+	// Serialization failures should be retried by the server instead of
+	// being reported to the client
+	const writers = 10
+	statuses := make(chan int, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			body, _ := json.Marshal(PhonebookRecord{Name: "Contended", Phone: strconv.Itoa(i)})
+			resp, _, err := client.sendJsonReq("PUT", "http://localhost:8080/api/v1/records/"+respBodyMap["id"], body)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			statuses <- resp.StatusCode
+		}(i)
+	}
+
+	for i := 0; i < writers; i++ {
+		require.Equal(t, 200, <-statuses)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	t.Parallel()
+
+	client := httpClient{}
+
+	resp, respBody, err := client.sendJsonReq("GET", "http://localhost:8080/healthz", []byte{})
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	liveness := make(map[string]string)
+	err = json.Unmarshal(respBody, &liveness)
+	require.NoError(t, err)
+	require.Equal(t, "ok", liveness["status"])
+
+	type Report struct {
+		Status string `json:"status"`
+		Database struct {
+			Status string `json:"status"`
+		} `json:"database"`
+		Schema struct {
+			Status string `json:"status"`
+			Current int32 `json:"current"`
+			Min int32 `json:"min"`
+			Max int32 `json:"max"`
+		} `json:"schema"`
+	}
+
+	resp, respBody, err = client.sendJsonReq("GET", "http://localhost:8080/readyz", []byte{})
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	var readiness Report
+	err = json.Unmarshal(respBody, &readiness)
+	require.NoError(t, err)
+	require.Equal(t, "ok", readiness.Status)
+	require.Equal(t, "ok", readiness.Database.Status)
+	require.Equal(t, "ok", readiness.Schema.Status)
+	require.True(t, readiness.Schema.Min > 0)
+	require.True(t, readiness.Schema.Min <= readiness.Schema.Max)
+	require.Equal(t, readiness.Schema.Max, readiness.Schema.Current)
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	client := httpClient{}
+
+	resp, _, err := client.sendJsonReq("GET", "http://localhost:8080/api/v1/records?limit=1", []byte{})
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	resp, respBody, err := client.sendJsonReq("GET", "http://localhost:8081/metrics", []byte{})
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	body := string(respBody)
+	require.Contains(t, body, `restexample_http_requests_total{route="/api/v1/records",method="GET",status="200"}`)
+	require.Contains(t, body, `restexample_http_request_duration_seconds_count{route="/api/v1/records",method="GET",status="200"}`)
+	require.Contains(t, body, "restexample_db_pool_total_conns ")
+	require.Contains(t, body, "restexample_db_pool_acquire_wait_seconds_total ")
+	require.Contains(t, body, "restexample_db_tx_retries_total ")
+	require.Contains(t, body, "restexample_schema_version ")
+	require.Contains(t, body, `restexample_build_info{version="v1.0"} 1`)
+}
+
+func TestConcurrentMigrations(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "0001_create_lock_test.sql"),
+		[]byte("CREATE TABLE lock_test(id INT PRIMARY KEY);\n---- create above / drop below ----\nDROP TABLE lock_test;\n"), 0644)
+	require.NoError(t, err)
+	// Fails with unique_violation if executed twice
+	err = ioutil.WriteFile(filepath.Join(dir, "0002_insert_lock_test.sql"),
+		[]byte("INSERT INTO lock_test(id) VALUES (1);\n"), 0644)
+	require.NoError(t, err)
+
+	// Each replica has its own connection, as it would in production
+	const replicas = 3
+	var started int32
+	errs := make(chan error, replicas)
+	for i := 0; i < replicas; i++ {
+		go func() {
+			ctx := context.Background()
+			conn, err := pgx.Connect(ctx, testDBConnString)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close(ctx)
+
+			migrator, err := migrate.NewMigratorEx(ctx, conn, "lock_test_version", &migrate.MigratorOptions{
+				LockTimeout: time.Minute,
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			migrator.OnStart = func(int32, string, string, string) {
+				atomic.AddInt32(&started, 1)
+			}
+
+			err = migrator.LoadMigrations(dir)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			errs <- migrator.Migrate(ctx, func(err error) (retry bool) {
+				return true
+			})
+		}()
+	}
+
+	for i := 0; i < replicas; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	// Every migration was executed exactly once
+	require.Equal(t, int32(2), atomic.LoadInt32(&started))
+}
+
+func TestLockHeartbeat(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Takes longer than the TTL of the lock
+	err = ioutil.WriteFile(filepath.Join(dir, "0001_create_heartbeat_test.sql"),
+		[]byte("SELECT pg_sleep(3);\nCREATE TABLE heartbeat_test(id INT PRIMARY KEY);\n"+
+			"INSERT INTO heartbeat_test(id) VALUES (1);\n"), 0644)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	pool, err := pgxpool.Connect(ctx, testDBConnString)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	const replicas = 2
+	var started int32
+	errs := make(chan error, replicas)
+	for i := 0; i < replicas; i++ {
+		go func() {
+			conn, err := pgx.Connect(ctx, testDBConnString)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close(ctx)
+
+			migrator, err := migrate.NewMigratorEx(ctx, conn, "heartbeat_test_version", &migrate.MigratorOptions{
+				LockTimeout: time.Minute,
+				LockTTL:     time.Second,
+				AcquireLockConn: func(ctx context.Context) (*pgx.Conn, func(), error) {
+					c, err := pool.Acquire(ctx)
+					if err != nil {
+						return nil, nil, err
+					}
+					return c.Conn(), c.Release, nil
+				},
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			migrator.OnStart = func(int32, string, string, string) {
+				atomic.AddInt32(&started, 1)
+			}
+
+			err = migrator.LoadMigrations(dir)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			errs <- migrator.Migrate(ctx, func(err error) (retry bool) {
+				return true
+			})
+		}()
+	}
+
+	for i := 0; i < replicas; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	// The lock didn't expire while the first replica was migrating
+	require.Equal(t, int32(1), atomic.LoadInt32(&started))
+}
+
+func TestNoTxMigration(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "0001_create_notx_test.sql"),
+		[]byte("CREATE TABLE notx_test(id INT PRIMARY KEY, name TEXT);\n"), 0644)
+	require.NoError(t, err)
+	// The second INSERT fails with unique_violation, leaving the index and the first row behind
+	err = ioutil.WriteFile(filepath.Join(dir, "0002_fill_notx_test.sql"),
+		[]byte("-- migrate:tx=none\nCREATE INDEX notx_test_name_idx ON notx_test(name);\n"+
+			"INSERT INTO notx_test(id, name) VALUES (1, 'a');\nINSERT INTO notx_test(id, name) VALUES (1, 'b');\n"), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "0003_alter_notx_test.sql"),
+		[]byte("-- migrate:tx=own\nALTER TABLE notx_test ADD COLUMN phone TEXT;\n"), 0644)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, testDBConnString)
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+
+	migrateNoTx := func() error {
+		migrator, err := migrate.NewMigrator(ctx, conn, "notx_test_version")
+		require.NoError(t, err)
+		err = migrator.LoadMigrations(dir)
+		require.NoError(t, err)
+		return migrator.Migrate(ctx, func(err error) (retry bool) {
+			return true
+		})
+	}
+
+	err = migrateNoTx()
+	require.Error(t, err)
+
+	// The first migration was committed, the second one is half-applied
+	var version int32
+	var dirty bool
+	err = conn.QueryRow(ctx, "SELECT version, dirty FROM notx_test_version").Scan(&version, &dirty)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), version)
+	require.True(t, dirty)
+
+	// Nothing is executed until the operator resolves the issue
+	err = migrateNoTx()
+	require.Error(t, err)
+	_, isDirtyErr := err.(migrate.DirtyError)
+	require.True(t, isDirtyErr)
+
+	_, err = conn.Exec(ctx, "UPDATE notx_test_version SET version = 2, dirty = false")
+	require.NoError(t, err)
+
+	err = migrateNoTx()
+	require.NoError(t, err)
+
+	err = conn.QueryRow(ctx, "SELECT version, dirty FROM notx_test_version").Scan(&version, &dirty)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), version)
+	require.False(t, dirty)
+}
+
+func TestChecksumDrift(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "0001_create_drift_test.sql")
+	err = ioutil.WriteFile(path, []byte("CREATE TABLE drift_test(id INT PRIMARY KEY);\n"), 0644)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, testDBConnString)
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+
+	migrateDrift := func(opts *migrate.MigratorOptions, onMismatch func(migrate.ChecksumMismatchError)) error {
+		migrator, err := migrate.NewMigratorEx(ctx, conn, "drift_test_version", opts)
+		require.NoError(t, err)
+		migrator.OnChecksumMismatch = onMismatch
+		err = migrator.LoadMigrations(dir)
+		require.NoError(t, err)
+		return migrator.Migrate(ctx, func(err error) (retry bool) {
+			return true
+		})
+	}
+
+	err = migrateDrift(&migrate.MigratorOptions{}, nil)
+	require.NoError(t, err)
+
+	var name, host string
+	err = conn.QueryRow(ctx, "SELECT name, host FROM drift_test_version_history WHERE sequence = 1").Scan(&name, &host)
+	require.NoError(t, err)
+	require.Equal(t, "0001_create_drift_test.sql", name)
+	require.NotEmpty(t, host)
+
+	// Edit the migration after it was applied
+	err = ioutil.WriteFile(path, []byte("CREATE TABLE drift_test(id INT PRIMARY KEY, name TEXT);\n"), 0644)
+	require.NoError(t, err)
+
+	err = migrateDrift(&migrate.MigratorOptions{}, nil)
+	require.Error(t, err)
+	mismatch, isMismatchErr := err.(migrate.ChecksumMismatchError)
+	require.True(t, isMismatchErr)
+	require.Equal(t, int64(1), mismatch.Version)
+
+	var reported []migrate.ChecksumMismatchError
+	err = migrateDrift(&migrate.MigratorOptions{AllowChecksumDrift: true}, func(err migrate.ChecksumMismatchError) {
+		reported = append(reported, err)
+	})
+	require.NoError(t, err)
+	require.Equal(t, []migrate.ChecksumMismatchError{mismatch}, reported)
+}
+
+func TestMigrateCLI(t *testing.T) {
+	t.Parallel()
+
+	out, err := exec.Command(binaryPath, "migrate", "status", "-c", testConfPath).Output()
+	require.NoError(t, err)
+	require.Regexp(t, `(?m)^1\s+0001_create_phonebook\.sql\s+applied\s`, string(out))
+
+	// The schema is up to date, so there is nothing to execute
+	out, err = exec.Command(binaryPath, "migrate", "up", "--dry-run", "-c", testConfPath).Output()
+	require.NoError(t, err)
+	require.Contains(t, string(out), "-- Nothing to do")
+
+	// Migrating to a non-existent version fails without changing anything
+	err = exec.Command(binaryPath, "migrate", "to", "100500", "-c", testConfPath).Run()
+	require.Error(t, err)
+	exitErr, isExitErr := err.(*exec.ExitError)
+	require.True(t, isExitErr)
+	require.Equal(t, 1, exitErr.ExitCode())
+}
+
+func TestMigrateStatusNotInitialized(t *testing.T) {
+	t.Parallel()
+
+	connString := scratchDatabase(t, "status_test")
+	cmd := exec.Command(binaryPath, "migrate", "status", "-c", testConfPath)
+	cmd.Env = append(os.Environ(), "RESTEXAMPLE_DB_URL="+connString)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	require.Contains(t, string(out), "Database is not initialized")
+	require.Regexp(t, `(?m)^1\s+0001_create_phonebook\.sql\s+pending\s`, string(out))
+
+	// Reading the status doesn't create the migration tables
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, connString)
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+
+	var tables int
+	err = conn.QueryRow(ctx,
+		"SELECT count(*) FROM information_schema.tables WHERE table_schema = current_schema()").Scan(&tables)
+	require.NoError(t, err)
+	require.Equal(t, 0, tables)
+}
+
+func TestGoMigrations(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "0001_create_go_test.sql"),
+		[]byte("CREATE TABLE go_test(id INT PRIMARY KEY, phone TEXT);\n"+
+			"INSERT INTO go_test VALUES (1, '8 (999) 123-45-67');\n"), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "0003_alter_go_test.sql"),
+		[]byte("ALTER TABLE go_test ADD COLUMN name TEXT;\n---- create above / drop below ----\n"+
+			"ALTER TABLE go_test DROP COLUMN name;\n"), 0644)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, testDBConnString)
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+
+	migrator, err := migrate.NewMigrator(ctx, conn, "go_test_version")
+	require.NoError(t, err)
+
+	var started []string
+	migrator.OnStart = func(sequence int32, name, direction, sql string) {
+		started = append(started, name+" "+direction)
+	}
+
+	err = migrator.RegisterGoMigration(migrate.GoMigration{
+		Sequence: 2,
+		Name:     "0002_normalize_phones",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "UPDATE go_test SET phone = $1 WHERE id = 1", "+79991234567")
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	err = migrator.LoadMigrations(dir)
+	require.NoError(t, err)
+
+	err = migrator.Migrate(ctx, func(err error) (retry bool) {
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"0001_create_go_test.sql up", "0002_normalize_phones up", "0003_alter_go_test.sql up"},
+		started)
+
+	var phone string
+	err = conn.QueryRow(ctx, "SELECT phone FROM go_test WHERE id = 1").Scan(&phone)
+	require.NoError(t, err)
+	require.Equal(t, "+79991234567", phone)
+
+	var name string
+	err = conn.QueryRow(ctx, "SELECT name FROM go_test_version_history WHERE sequence = 2").Scan(&name)
+	require.NoError(t, err)
+	require.Equal(t, "0002_normalize_phones", name)
+
+	// Rolling back a Go migration updates the version as usual
+	err = migrator.MigrateTo(ctx, 1, func(err error) (retry bool) {
+		return true
+	})
+	require.NoError(t, err)
+
+	version, err := migrator.GetCurrentVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), version)
+}
+
+func TestBackfill(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	pool, err := pgxpool.Connect(ctx, testDBConnString)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	_, err = pool.Exec(ctx, "CREATE TABLE backfill_test(id INT PRIMARY KEY, phone TEXT NOT NULL)")
+	require.NoError(t, err)
+	_, err = pool.Exec(ctx, "INSERT INTO backfill_test SELECT i, '7999' || i FROM generate_series(1, 250) AS i")
+	require.NoError(t, err)
+
+	runner, err := backfill.NewRunner(ctx, pool, "backfill_test_progress")
+	require.NoError(t, err)
+
+	batches := 0
+	failOnBatch := 2
+	err = runner.Register(backfill.Backfill{
+		Name:      "add_plus",
+		BatchSize: 100,
+		Batch: func(ctx context.Context, tx pgx.Tx, after int64, limit int) (int64, int, error) {
+			batches++
+			if batches == failOnBatch {
+				return 0, 0, errors.New("simulated crash")
+			}
+
+			var last int64
+			var rows int
+			err := tx.QueryRow(ctx, "SELECT coalesce(max(id), 0), count(*) FROM "+
+				"(SELECT id FROM backfill_test WHERE id > $1 ORDER BY id LIMIT $2) AS batch", after, limit).
+				Scan(&last, &rows)
+			if err != nil || rows == 0 {
+				return 0, 0, err
+			}
+
+			_, err = tx.Exec(ctx, "UPDATE backfill_test SET phone = '+' || phone WHERE id > $1 AND id <= $2", after, last)
+			return last, rows, err
+		},
+	})
+	require.NoError(t, err)
+
+	err = runner.Run(ctx, "add_plus")
+	require.Error(t, err)
+
+	progress, err := runner.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, progress, 1)
+	require.Equal(t, int64(100), progress[0].LastKey)
+	require.Equal(t, int64(100), progress[0].Rows)
+	require.Nil(t, progress[0].FinishedAt)
+
+	// The next run continues from the last committed batch
+	err = runner.Run(ctx, "add_plus")
+	require.NoError(t, err)
+
+	progress, err = runner.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(250), progress[0].Rows)
+	require.NotNil(t, progress[0].FinishedAt)
+
+	var updated int
+	err = pool.QueryRow(ctx, "SELECT count(*) FROM backfill_test WHERE phone LIKE '+7999%'").Scan(&updated)
+	require.NoError(t, err)
+	require.Equal(t, 250, updated)
+}
+
+func TestTimestampVersions(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, testDBConnString)
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+
+	retry := func(err error) (retry bool) {
+		return true
+	}
+	writeMigrations := func(files map[string]string) string {
+		dir, err := ioutil.TempDir("", "migrations")
+		require.NoError(t, err)
+		for name, sql := range files {
+			err = ioutil.WriteFile(filepath.Join(dir, name), []byte(sql), 0644)
+			require.NoError(t, err)
+		}
+		return dir
+	}
+	newMigrator := func(dir string, opts migrate.MigratorOptions) *migrate.Migrator {
+		migrator, err := migrate.NewMigratorEx(ctx, conn, "ts_test_version", &opts)
+		require.NoError(t, err)
+		err = migrator.LoadMigrations(dir)
+		require.NoError(t, err)
+		return migrator
+	}
+
+	// The database is migrated with sequential versions first
+	sequentialDir := writeMigrations(map[string]string{
+		"0001_create_ts_test.sql": "CREATE TABLE ts_test(id INT PRIMARY KEY);",
+		"0002_add_name.sql":       "ALTER TABLE ts_test ADD COLUMN name TEXT;",
+	})
+	defer os.RemoveAll(sequentialDir)
+	err = newMigrator(sequentialDir, migrate.MigratorOptions{}).Migrate(ctx, retry)
+	require.NoError(t, err)
+
+	timestampFiles := map[string]string{
+		"20200206120000_create_ts_test.sql": "CREATE TABLE ts_test(id INT PRIMARY KEY);",
+		"20200310090000_add_name.sql":       "ALTER TABLE ts_test ADD COLUMN name TEXT;",
+	}
+	timestampDir := writeMigrations(timestampFiles)
+	defer os.RemoveAll(timestampDir)
+	timestampOpts := migrate.MigratorOptions{Versioning: migrate.TimestampVersioning}
+
+	// The history has to be converted before migrating with timestamp versions
+	migrator := newMigrator(timestampDir, timestampOpts)
+	err = migrator.Migrate(ctx, retry)
+	var mismatch migrate.VersioningMismatchError
+	require.True(t, errors.As(err, &mismatch), err)
+
+	conversions, err := migrator.ConvertToTimestamps(ctx, false)
+	require.NoError(t, err)
+	require.Equal(t, []migrate.Conversion{
+		{OldVersion: 1, OldName: "0001_create_ts_test.sql", NewVersion: 20200206120000,
+			NewName: "20200206120000_create_ts_test.sql"},
+		{OldVersion: 2, OldName: "0002_add_name.sql", NewVersion: 20200310090000,
+			NewName: "20200310090000_add_name.sql"},
+	}, conversions)
+
+	err = migrator.Migrate(ctx, retry)
+	require.NoError(t, err)
+
+	// A migration merged from another branch is older than the last applied one
+	timestampFiles["20200301100000_add_phone.sql"] = "ALTER TABLE ts_test ADD COLUMN phone TEXT;"
+	mergedDir := writeMigrations(timestampFiles)
+	defer os.RemoveAll(mergedDir)
+
+	err = newMigrator(mergedDir, timestampOpts).Migrate(ctx, retry)
+	var outOfOrder migrate.OutOfOrderError
+	require.True(t, errors.As(err, &outOfOrder), err)
+	require.Equal(t, int64(20200310090000), outOfOrder.LastApplied)
+
+	timestampOpts.AllowOutOfOrder = true
+	err = newMigrator(mergedDir, timestampOpts).Migrate(ctx, retry)
+	require.NoError(t, err)
+
+	var version int32
+	err = conn.QueryRow(ctx, "SELECT version FROM ts_test_version").Scan(&version)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), version)
+
+	var phones int
+	err = conn.QueryRow(ctx, "SELECT count(phone) FROM ts_test").Scan(&phones)
+	require.NoError(t, err)
+	require.Equal(t, 0, phones)
+}
+
+func TestMigrateNew(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "0001_create_new_test.sql"),
+		[]byte("CREATE TABLE new_test(id INT PRIMARY KEY);\n"), 0644)
+	require.NoError(t, err)
+
+	out, err := exec.Command(binaryPath, "migrate", "new", "add_name", "--migrations-dir", dir,
+		"-c", testConfPath).Output()
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "0002_add_name.sql")
+	require.Equal(t, path, strings.TrimSpace(string(out)))
+	body, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(body), migrate.Separator)
+
+	// Names which would not be loaded are refused
+	err = exec.Command(binaryPath, "migrate", "new", "shared/add_phone", "--migrations-dir", dir,
+		"-c", testConfPath).Run()
+	require.Error(t, err)
+}
+
+func TestMigrateLint(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "0001_create_lint_test.sql"),
+		[]byte("CREATE TABLE lint_test(id INT PRIMARY KEY);\n---- create above / drop below ----\n"+
+			"DROP TABLE lint_test;\n"), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "0002_drop_lint_test.sql"),
+		[]byte("DROP TABLE lint_test;\n"), 0644)
+	require.NoError(t, err)
+
+	out, err := exec.Command(binaryPath, "migrate", "lint", "--migrations-dir", dir, "-c", testConfPath).Output()
+	require.Error(t, err)
+	require.Contains(t, string(out), "0002_drop_lint_test.sql: drop-table:")
+	require.Contains(t, string(out), "0002_drop_lint_test.sql: missing-down:")
+
+	// Findings can be suppressed inline
+	err = ioutil.WriteFile(filepath.Join(dir, "0002_drop_lint_test.sql"),
+		[]byte("-- lint:ignore drop-table,missing-down the table was never used\nDROP TABLE lint_test;\n"), 0644)
+	require.NoError(t, err)
+	// CockroachDB has no CREATE INDEX CONCURRENTLY and doesn't need it
+	err = ioutil.WriteFile(filepath.Join(dir, "0003_index_lint_test.sql"),
+		[]byte("-- migrate:tx=none\n{{if .CockroachDB}}CREATE INDEX lint_test_idx ON lint_test(id);{{else}}"+
+			"CREATE INDEX CONCURRENTLY lint_test_idx ON lint_test(id);{{end}}\n"+
+			"---- create above / drop below ----\nDROP INDEX lint_test_idx;\n"), 0644)
+	require.NoError(t, err)
+
+	err = exec.Command(binaryPath, "migrate", "lint", "--migrations-dir", dir, "-c", testConfPath).Run()
+	require.NoError(t, err)
+}
+
+func TestMigrationsData(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "0001_create_data_test.sql"),
+		[]byte("CREATE TABLE data_test(id INT PRIMARY KEY);\n---- create above / drop below ----\n"+
+			"DROP TABLE data_test;\n"), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "R__data_test_grants.sql"),
+		[]byte("GRANT SELECT ON ALL TABLES IN SCHEMA public TO {{.grant_role}};\n"), 0644)
+	require.NoError(t, err)
+
+	// The key is not configured
+	out, err := exec.Command(binaryPath, "migrate", "lint", "--migrations-dir", dir, "-c", testConfPath).CombinedOutput()
+	require.Error(t, err)
+	require.Contains(t, string(out), `map has no entry for key "grant_role"`)
+
+	cmd := exec.Command(binaryPath, "migrate", "lint", "--migrations-dir", dir, "-c", testConfPath)
+	cmd.Env = append(os.Environ(), "RESTEXAMPLE_MIGRATIONS_DATA_GRANT_ROLE=reader")
+	out, err = cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+}
+
+func TestMigrationsDataDrift(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "0001_create_data_drift_test.sql"),
+		[]byte("CREATE TABLE data_drift_test(id INT PRIMARY KEY, note TEXT DEFAULT '{{.note}}');\n"), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "R__data_drift_test_view.sql"),
+		[]byte("CREATE OR REPLACE VIEW data_drift_test_view AS SELECT id, '{{.label}}' AS label FROM data_drift_test;\n"),
+		0644)
+	require.NoError(t, err)
+
+	connString := scratchDatabase(t, "data_drift_test")
+	migrateUp := func(note, label string) ([]byte, error) {
+		cmd := exec.Command(binaryPath, "migrate", "up", "--migrations-dir", dir, "-c", testConfPath)
+		cmd.Env = append(os.Environ(), "RESTEXAMPLE_DB_URL="+connString,
+			"RESTEXAMPLE_MIGRATIONS_DATA_NOTE="+note, "RESTEXAMPLE_MIGRATIONS_DATA_LABEL="+label)
+		return cmd.CombinedOutput()
+	}
+
+	out, err := migrateUp("a", "a")
+	require.NoError(t, err, string(out))
+
+	// A repeatable migration is re-applied with the new value
+	out, err = migrateUp("a", "b")
+	require.NoError(t, err, string(out))
+
+	// The applied migration was rendered with another value
+	out, err = migrateUp("b", "b")
+	require.Error(t, err)
+	require.Contains(t, string(out), "0001_create_data_drift_test.sql")
+}
+
+// scratchDatabase creates an empty database on the test DBMS and returns
+// the connection string for it
+func scratchDatabase(t *testing.T, name string) string {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, testDBConnString)
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(ctx, "CREATE DATABASE "+name)
+	require.NoError(t, err)
+
+	u, err := url.Parse(testDBConnString)
+	require.NoError(t, err)
+	u.Path = "/" + name
+	return u.String()
+}
+
+// verifyMigrations runs the up/down/up verification of the migrations in dir
+// on a scratch database
+func verifyMigrations(t *testing.T, dbName, dir string) ([]*migrate.Migration, error) {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, scratchDatabase(t, dbName))
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+
+	cockroachDB, err := migrate.IsCockroachDB(ctx, conn)
+	require.NoError(t, err)
+
+	migrator, err := migrate.NewMigrator(ctx, conn, "schema_version")
+	require.NoError(t, err)
+	migrator.Data["CockroachDB"] = cockroachDB
+	err = migrator.LoadMigrations(dir)
+	require.NoError(t, err)
+
+	return migrator.Verify(ctx, func(err error) (retry bool) {
+		return true
+	})
+}
+
+func TestVerifyMigrations(t *testing.T) {
+	t.Parallel()
+
+	// The migrations embedded into the binary
+	cmd := exec.Command(binaryPath, "migrate", "verify", "-c", testConfPath)
+	cmd.Env = append(os.Environ(), "RESTEXAMPLE_DB_URL="+scratchDatabase(t, "verify_test"))
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	// The data migrations would be executed twice
+	cmd = exec.Command(binaryPath, "migrate", "verify", "-c", testConfPath)
+	cmd.Env = append(os.Environ(), "RESTEXAMPLE_DB_URL="+testDBConnString)
+	require.Error(t, cmd.Run())
+}
+
+func TestVerifyBrokenDown(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "0001_create_verify_test.sql"),
+		[]byte("CREATE TABLE verify_test(id INT PRIMARY KEY);\n---- create above / drop below ----\n"+
+			"DROP TABLE verify_test;\n"), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "0002_add_phone.sql"),
+		[]byte("ALTER TABLE verify_test ADD COLUMN phone TEXT;\n---- create above / drop below ----\n"+
+			"SELECT 1;\n"), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "0003_seed.sql"),
+		[]byte("INSERT INTO verify_test(id) VALUES (1);\n"), 0644)
+	require.NoError(t, err)
+
+	_, err = verifyMigrations(t, "verify_broken_test", dir)
+	var mismatch migrate.SchemaMismatchError
+	require.True(t, errors.As(err, &mismatch), err)
+	require.Equal(t, "0002_add_phone.sql", mismatch.Name)
+	require.Equal(t, "down", mismatch.Direction)
+	require.Empty(t, mismatch.Missing)
+	require.NotEmpty(t, mismatch.Extra)
+	require.Contains(t, mismatch.Extra[0], "phone")
+
+	// Without the broken migration the irreversible one is only applied
+	err = os.Remove(filepath.Join(dir, "0002_add_phone.sql"))
+	require.NoError(t, err)
+	err = os.Rename(filepath.Join(dir, "0003_seed.sql"), filepath.Join(dir, "0002_seed.sql"))
+	require.NoError(t, err)
+
+	notVerified, err := verifyMigrations(t, "verify_fixed_test", dir)
+	require.NoError(t, err)
+	require.Len(t, notVerified, 1)
+	require.Equal(t, "0002_seed.sql", notVerified[0].Name)
+}
+
+func TestSchemaFence(t *testing.T) {
+	t.Parallel()
+
+	// A schema migrated by a newer release
+	connString := scratchDatabase(t, "fence_test")
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, connString)
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "CREATE TABLE schema_version(version int4 NOT NULL, dirty bool NOT NULL DEFAULT false)")
+	require.NoError(t, err)
+	_, err = conn.Exec(ctx, "INSERT INTO schema_version(version) VALUES (100500)")
+	require.NoError(t, err)
+
+	env := append(os.Environ(), "RESTEXAMPLE_DB_URL="+connString,
+		"RESTEXAMPLE_LISTEN=localhost:8090", "RESTEXAMPLE_ADMIN_LISTEN=localhost:8091")
+
+	cmd := exec.Command(binaryPath, "--skip-migration", "-c", testConfPath)
+	cmd.Env = env
+	err = cmd.Run()
+	require.Error(t, err)
+
+	// The schema is not rolled back to the bundled migrations
+	cmd = exec.Command(binaryPath, "-c", testConfPath)
+	cmd.Env = env
+	err = cmd.Run()
+	require.Error(t, err)
+	var schemaVersion int32
+	err = conn.QueryRow(ctx, "SELECT version FROM schema_version").Scan(&schemaVersion)
+	require.NoError(t, err)
+	require.Equal(t, int32(100500), schemaVersion)
+
+	cmd = exec.Command(binaryPath, "--skip-migration", "-c", testConfPath)
+	cmd.Env = append(env, "RESTEXAMPLE_SCHEMA_INCOMPATIBLE=read-only")
+	err = cmd.Start()
+	require.NoError(t, err)
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	client := httpClient{}
+	var resp *http.Response
+	for attempt := 0; attempt < 20; attempt++ {
+		resp, _, err = client.sendJsonReq("GET", "http://localhost:8090/healthz", []byte{})
+		if err == nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	resp, _, err = client.sendJsonReq("POST", "http://localhost:8090/api/v1/records",
+		[]byte(`{"name":"Alice","phone":"123"}`))
+	require.NoError(t, err)
+	require.Equal(t, 503, resp.StatusCode)
+
+	// The service is ready to serve reads
+	resp, respBody, err := client.sendJsonReq("GET", "http://localhost:8090/readyz", []byte{})
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	var readiness struct {
+		Status string `json:"status"`
+		Schema struct {
+			Status string `json:"status"`
+			Current int32 `json:"current"`
+		} `json:"schema"`
+	}
+	err = json.Unmarshal(respBody, &readiness)
+	require.NoError(t, err)
+	require.Equal(t, "read-only", readiness.Status)
+	require.Equal(t, "ahead", readiness.Schema.Status)
+	require.Equal(t, int32(100500), readiness.Schema.Current)
+}
+
+func TestRepeatableMigrations(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "0001_create_rep_test.sql"),
+		[]byte("CREATE TABLE rep_test(id INT PRIMARY KEY, name TEXT);\n"+
+			"INSERT INTO rep_test VALUES (1, 'Alice');\n---- create above / drop below ----\nDROP TABLE rep_test;\n"), 0644)
+	require.NoError(t, err)
+	viewPath := filepath.Join(dir, "R__rep_test_view.sql")
+	err = ioutil.WriteFile(viewPath, []byte("CREATE OR REPLACE VIEW rep_test_view AS SELECT id FROM rep_test;\n"), 0644)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, testDBConnString)
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+
+	runMigrations := func() []string {
+		migrator, err := migrate.NewMigrator(ctx, conn, "rep_test_version")
+		require.NoError(t, err)
+
+		var started []string
+		migrator.OnStart = func(sequence int32, name, direction, sql string) {
+			started = append(started, name+" "+direction)
+		}
+		err = migrator.LoadMigrations(dir)
+		require.NoError(t, err)
+		err = migrator.Migrate(ctx, func(err error) (retry bool) {
+			return true
+		})
+		require.NoError(t, err)
+		return started
+	}
+
+	require.Equal(t, []string{"0001_create_rep_test.sql up", "R__rep_test_view.sql repeatable"}, runMigrations())
+
+	// Nothing changed
+	require.Empty(t, runMigrations())
+
+	err = ioutil.WriteFile(viewPath, []byte("CREATE OR REPLACE VIEW rep_test_view AS SELECT id, name FROM rep_test;\n"),
+		0644)
+	require.NoError(t, err)
+	require.Equal(t, []string{"R__rep_test_view.sql repeatable"}, runMigrations())
+
+	var name string
+	err = conn.QueryRow(ctx, "SELECT name FROM rep_test_view WHERE id = 1").Scan(&name)
+	require.NoError(t, err)
+	require.Equal(t, "Alice", name)
 }
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"context"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/dbtx"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/migrate"
+	"github.com/jackc/pgx/v4/pgxpool"
+	log "github.com/sirupsen/logrus"
+)
+
+// BuildInfo reports the version of the binary as a label
+func BuildInfo(version string) Collector {
+	return func(ctx context.Context, w *Writer) {
+		w.Family("build_info", "gauge", "Build information, the value is always 1.")
+		w.Sample("build_info", Labels{"version", version}, 1)
+	}
+}
+
+// PoolStats reports pgxpool statistics
+func PoolStats(pool *pgxpool.Pool) Collector {
+	return func(ctx context.Context, w *Writer) {
+		stat := pool.Stat()
+
+		w.Family("db_pool_acquired_conns", "gauge", "Number of currently acquired connections.")
+		w.Sample("db_pool_acquired_conns", nil, float64(stat.AcquiredConns()))
+		w.Family("db_pool_idle_conns", "gauge", "Number of currently idle connections.")
+		w.Sample("db_pool_idle_conns", nil, float64(stat.IdleConns()))
+		w.Family("db_pool_total_conns", "gauge", "Total number of connections in the pool.")
+		w.Sample("db_pool_total_conns", nil, float64(stat.TotalConns()))
+		w.Family("db_pool_max_conns", "gauge", "Maximum size of the pool.")
+		w.Sample("db_pool_max_conns", nil, float64(stat.MaxConns()))
+		w.Family("db_pool_acquires_total", "counter", "Total number of successful acquires.")
+		w.Sample("db_pool_acquires_total", nil, float64(stat.AcquireCount()))
+		w.Family("db_pool_empty_acquires_total", "counter", "Total number of acquires which had to wait for a connection.")
+		w.Sample("db_pool_empty_acquires_total", nil, float64(stat.EmptyAcquireCount()))
+		w.Family("db_pool_canceled_acquires_total", "counter", "Total number of acquires canceled by a context.")
+		w.Sample("db_pool_canceled_acquires_total", nil, float64(stat.CanceledAcquireCount()))
+		w.Family("db_pool_acquire_wait_seconds_total", "counter", "Total time spent waiting for a connection.")
+		w.Sample("db_pool_acquire_wait_seconds_total", nil, stat.AcquireDuration().Seconds())
+	}
+}
+
+// TxRetries reports the number of transactions retried by dbtx.RunInTx
+func TxRetries() Collector {
+	return func(ctx context.Context, w *Writer) {
+		w.Family("db_tx_retries_total", "counter", "Total number of retried transactions.")
+		w.Sample("db_tx_retries_total", nil, float64(dbtx.Retries()))
+	}
+}
+
+// SchemaVersion reports the current schema version. The version is read
+// from the database on every scrape, since it can be changed by another
+// replica. Nothing is reported if the database is unavailable.
+func SchemaVersion(pool *pgxpool.Pool, versionTable string) Collector {
+	return func(ctx context.Context, w *Writer) {
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			log.Warnf("Unable to acquire a database connection for metrics: %v", err)
+			return
+		}
+		defer conn.Release()
+
+		version, err := migrate.GetVersion(ctx, conn.Conn(), versionTable)
+		if err != nil {
+			log.Warnf("Unable to get schema version for metrics: %v", err)
+			return
+		}
+
+		w.Family("schema_version", "gauge", "Current version of the database schema.")
+		w.Sample("schema_version", nil, float64(version))
+	}
+}
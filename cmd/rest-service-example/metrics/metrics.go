@@ -0,0 +1,272 @@
+package metrics
+
+// A minimal implementation of Prometheus metrics. Only what the service
+// needs is implemented: request counters, latency histograms and values
+// which are collected at scrape time. The output is in the text exposition
+// format, see https://prometheus.io/docs/instrumenting/exposition_formats/
+//
+// client_golang is not used on purpose: the dependencies are vendored and it
+// would bring protobuf, procfs and a few more modules for a handful of
+// metrics, while the text format is simple and stable.
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+	namespace   = "restexample_"
+
+	scrapeTimeout = 5 * time.Second
+
+	// StatusClientClosedRequest is recorded for the requests canceled by the
+	// client before a response was written, the same code is used by nginx
+	StatusClientClosedRequest = 499
+)
+
+// Latency buckets in seconds, same as the default ones in client_golang
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Collector writes metrics which values are known only at scrape time,
+// e.g. connection pool statistics.
+type Collector func(ctx context.Context, w *Writer)
+
+type requestKey struct {
+	route  string
+	method string
+	status int
+}
+
+type histogram struct {
+	counts []uint64 // non-cumulative, one per bucket plus +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(value float64) {
+	i := sort.SearchFloat64s(latencyBuckets, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+type Registry struct {
+	mu sync.Mutex
+	// The request counters are the counts of the histograms
+	latencies  map[requestKey]*histogram
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		latencies: make(map[requestKey]*histogram),
+	}
+}
+
+// Register adds a collector called on every scrape
+func (reg *Registry) Register(c Collector) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.collectors = append(reg.collectors, c)
+}
+
+func (reg *Registry) observeRequest(route, method string, status int, duration time.Duration) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	k := requestKey{route, method, status}
+	h, ok := reg.latencies[k]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		reg.latencies[k] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = 200
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// Middleware counts requests and measures their latency. Requests are
+// labeled with the route template, e.g. /api/v1/records/{id:[0-9]+}, rather
+// than the actual path so that the number of time series stays bounded.
+// It should be installed with Router.Use. Requests which didn't match any
+// route are labeled with route="none". Requests canceled by the client before
+// anything was written are labeled with status="499".
+func (reg *Registry) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+
+		route := "none"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tmpl, err := cr.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		status := sr.status
+		if status == 0 {
+			status = 200
+			if r.Context().Err() == context.Canceled {
+				status = StatusClientClosedRequest
+			}
+		}
+		reg.observeRequest(route, r.Method, status, time.Since(start))
+	})
+}
+
+// Handler serves all the metrics in the text exposition format
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout)
+		defer cancel()
+
+		w.Header().Set("Content-Type", ContentType)
+		mw := &Writer{w: w}
+		reg.write(mw)
+
+		reg.mu.Lock()
+		collectors := append([]Collector(nil), reg.collectors...)
+		reg.mu.Unlock()
+		for _, c := range collectors {
+			c(ctx, mw)
+		}
+
+		if mw.err != nil {
+			log.Errorf("Unable to write metrics: %v", mw.err)
+		}
+	})
+}
+
+func (reg *Registry) write(w *Writer) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	requestKeys := make([]requestKey, 0, len(reg.latencies))
+	for k := range reg.latencies {
+		requestKeys = append(requestKeys, k)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		a, b := requestKeys[i], requestKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+
+	w.Family("http_requests_total", "counter", "Total number of HTTP requests.")
+	for _, k := range requestKeys {
+		w.Sample("http_requests_total",
+			Labels{"route", k.route, "method", k.method, "status", strconv.Itoa(k.status)},
+			float64(reg.latencies[k].count))
+	}
+
+	w.Family("http_request_duration_seconds", "histogram", "HTTP request latency.")
+	for _, k := range requestKeys {
+		h := reg.latencies[k]
+		status := strconv.Itoa(k.status)
+		cumulative := uint64(0)
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			w.Sample("http_request_duration_seconds_bucket",
+				Labels{"route", k.route, "method", k.method, "status", status, "le", formatFloat(le)},
+				float64(cumulative))
+		}
+		w.Sample("http_request_duration_seconds_bucket",
+			Labels{"route", k.route, "method", k.method, "status", status, "le", "+Inf"},
+			float64(h.count))
+		labels := Labels{"route", k.route, "method", k.method, "status", status}
+		w.Sample("http_request_duration_seconds_sum", labels, h.sum)
+		w.Sample("http_request_duration_seconds_count", labels, float64(h.count))
+	}
+}
+
+// Labels is a list of label names and values: name1, value1, name2, value2...
+type Labels []string
+
+// Writer writes metrics in the text exposition format. The first error
+// is remembered and all further writes are ignored.
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+// Family writes HELP and TYPE lines. All samples of the family should
+// follow it. Names are prefixed with the service namespace.
+func (w *Writer) Family(name, typ, help string) {
+	w.printf("# HELP %s%s %s\n# TYPE %s%s %s\n", namespace, name, help, namespace, name, typ)
+}
+
+func (w *Writer) Sample(name string, labels Labels, value float64) {
+	var sb strings.Builder
+	sb.WriteString(namespace)
+	sb.WriteString(name)
+	if len(labels) > 0 {
+		sb.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(labels[i])
+			sb.WriteString(`="`)
+			sb.WriteString(escapeLabelValue(labels[i+1]))
+			sb.WriteByte('"')
+		}
+		sb.WriteByte('}')
+	}
+	w.printf("%s %s\n", sb.String(), formatFloat(value))
+}
+
+func (w *Writer) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, args...)
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
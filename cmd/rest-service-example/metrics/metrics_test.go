@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	reg := NewRegistry()
+	r := mux.NewRouter()
+	r.Use(reg.Middleware)
+	r.HandleFunc("/api/v1/records/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "0" {
+			w.WriteHeader(404)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}).Methods("GET")
+	r.NotFoundHandler = reg.Middleware(http.NotFoundHandler())
+
+	for _, path := range []string{"/api/v1/records/1", "/api/v1/records/2", "/api/v1/records/0", "/nowhere"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	// The client went away before the handler wrote anything
+	ctx, cancel := context.WithCancel(context.Background())
+	r.HandleFunc("/canceled", func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+	}).Methods("GET")
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/canceled", nil).WithContext(ctx))
+
+	reg.Register(func(ctx context.Context, w *Writer) {
+		w.Family("answer", "gauge", "The answer.")
+		w.Sample("answer", Labels{"quoted", "a \"b\"\n"}, 42)
+	})
+
+	rec := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+	body, err := ioutil.ReadAll(rec.Body)
+	require.NoError(t, err)
+	lines := strings.Split(string(body), "\n")
+
+	expected := []string{
+		"# TYPE restexample_http_requests_total counter",
+		`restexample_http_requests_total{route="/api/v1/records/{id:[0-9]+}",method="GET",status="200"} 2`,
+		`restexample_http_requests_total{route="/api/v1/records/{id:[0-9]+}",method="GET",status="404"} 1`,
+		`restexample_http_requests_total{route="none",method="GET",status="404"} 1`,
+		`restexample_http_requests_total{route="/canceled",method="GET",status="499"} 1`,
+		"# TYPE restexample_http_request_duration_seconds histogram",
+		`restexample_http_request_duration_seconds_bucket{route="/api/v1/records/{id:[0-9]+}",method="GET",status="200",le="10"} 2`,
+		`restexample_http_request_duration_seconds_bucket{route="/api/v1/records/{id:[0-9]+}",method="GET",status="200",le="+Inf"} 2`,
+		`restexample_http_request_duration_seconds_count{route="/api/v1/records/{id:[0-9]+}",method="GET",status="200"} 2`,
+		`restexample_http_request_duration_seconds_count{route="/api/v1/records/{id:[0-9]+}",method="GET",status="404"} 1`,
+		"# HELP restexample_answer The answer.",
+		`restexample_answer{quoted="a \"b\"\n"} 42`,
+	}
+	for _, e := range expected {
+		require.Contains(t, lines, e)
+	}
+}
@@ -0,0 +1,105 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DryRun writes the SQL which MigrateTo would execute to get to targetVersion
+// without executing it. The output is a script in execution order including
+// transaction boundaries and version updates, suitable for a review.
+func (m *Migrator) DryRun(ctx context.Context, targetVersion int32, w io.Writer) error {
+	currentVersion, dirty, err := m.GetState(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Unable to get current schema version")
+	}
+
+	if dirty {
+		return DirtyError{Version: currentVersion, versionTable: m.versionTable}
+	}
+
+	steps, err := m.prepare(ctx, currentVersion, targetVersion)
+	if err != nil {
+		return err
+	}
+
+	err = m.verifyChecksums(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Repeatable migrations are applied only after the latest version. The
+	// ones changed by the steps are not known in advance, all the changed
+	// files are pending already.
+	var repeatables []*RepeatableMigration
+	if targetVersion == int32(len(m.Migrations)) {
+		repeatables, err = m.PendingRepeatables(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.writeScript(w, currentVersion, targetVersion, steps, repeatables)
+}
+
+func (m *Migrator) writeScript(w io.Writer, currentVersion, targetVersion int32, steps []step,
+	repeatables []*RepeatableMigration) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "-- Dry run: %s %d -> %d\n", m.versionTable, currentVersion, targetVersion)
+	if len(steps) == 0 && len(repeatables) == 0 {
+		fmt.Fprintf(bw, "-- Nothing to do\n")
+	}
+
+	for len(steps) > 0 {
+		n := nextBatch(steps)
+		if steps[0].migration.TxMode == TxNone {
+			s := steps[0]
+			fmt.Fprintf(bw, "\n-- %s (%s, no transaction)\n", s.migration.Name, s.direction)
+			fmt.Fprintf(bw, "update %s set dirty=true;\n", m.versionTable)
+			for _, stmt := range splitStatements(s.sql) {
+				fmt.Fprintf(bw, "%s;\n", stmt)
+			}
+			fmt.Fprintf(bw, "update %s set version=%d, dirty=false;\n", m.versionTable, s.version)
+		} else {
+			fmt.Fprintf(bw, "\nbegin isolation level serializable;\n")
+			for _, s := range steps[:n] {
+				fmt.Fprintf(bw, "\n-- %s (%s)\n", s.migration.Name, s.direction)
+				if s.fn != nil {
+					fmt.Fprintf(bw, "-- Go migration, the SQL is not known in advance\n")
+				} else {
+					fmt.Fprintf(bw, "%s\n", terminate(s.sql))
+				}
+				fmt.Fprintf(bw, "update %s set version=%d;\n", m.versionTable, s.version)
+			}
+			fmt.Fprintf(bw, "\ncommit;\n")
+		}
+		steps = steps[n:]
+	}
+
+	for _, r := range repeatables {
+		fmt.Fprintf(bw, "\nbegin isolation level serializable;\n")
+		fmt.Fprintf(bw, "\n-- %s (repeatable)\n%s\n", r.Name, terminate(r.SQL))
+		fmt.Fprintf(bw, "\ncommit;\n")
+	}
+
+	return bw.Flush()
+}
+
+// terminate makes sure the last statement of sql ends with a semicolon, so
+// that it's not merged with the next one in the script
+func terminate(sql string) string {
+	sql = strings.TrimSpace(sql)
+	if len(splitStatements(sql)) == 0 || strings.HasSuffix(sql, ";") {
+		return sql
+	}
+	// The last line may end with a comment, which would swallow the semicolon
+	if strings.Contains(sql[strings.LastIndex(sql, "\n")+1:], "--") {
+		return sql + "\n;"
+	}
+	return sql + ";"
+}
@@ -0,0 +1,83 @@
+package migrate
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteScript(t *testing.T) {
+	t.Parallel()
+
+	m := &Migrator{versionTable: "schema_version"}
+	m.AppendMigration("0001_create_t.sql", "CREATE TABLE t(id INT, name TEXT);", "DROP TABLE t;")
+	m.AppendMigration("0002_insert_t.sql", "INSERT INTO t VALUES (1, 'a') -- the first row", "DELETE FROM t;")
+	m.AppendMigration("0003_index_t.sql", "-- migrate:tx=none\nCREATE INDEX CONCURRENTLY t_idx ON t(name);\nANALYZE t;", "DROP INDEX t_idx;")
+	m.Migrations[2].TxMode = TxNone
+
+	steps, err := m.plan(0, 3)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	err = m.writeScript(&buf, 0, 3, steps, nil)
+	require.NoError(t, err)
+	require.Equal(t, `-- Dry run: schema_version 0 -> 3
+
+begin isolation level serializable;
+
+-- 0001_create_t.sql (up)
+CREATE TABLE t(id INT, name TEXT);
+update schema_version set version=1;
+
+-- 0002_insert_t.sql (up)
+INSERT INTO t VALUES (1, 'a') -- the first row
+;
+update schema_version set version=2;
+
+commit;
+
+-- 0003_index_t.sql (up, no transaction)
+update schema_version set dirty=true;
+-- migrate:tx=none
+CREATE INDEX CONCURRENTLY t_idx ON t(name);
+ANALYZE t;
+update schema_version set version=3, dirty=false;
+`, buf.String())
+
+	steps, err = m.plan(3, 1)
+	require.NoError(t, err)
+
+	buf.Reset()
+	err = m.writeScript(&buf, 3, 1, steps, nil)
+	require.NoError(t, err)
+	require.Equal(t, `-- Dry run: schema_version 3 -> 1
+
+-- 0003_index_t.sql (down, no transaction)
+update schema_version set dirty=true;
+DROP INDEX t_idx;
+update schema_version set version=2, dirty=false;
+
+begin isolation level serializable;
+
+-- 0002_insert_t.sql (down)
+DELETE FROM t;
+update schema_version set version=1;
+
+commit;
+`, buf.String())
+
+	// Repeatable migrations go after the versioned ones
+	buf.Reset()
+	err = m.writeScript(&buf, 3, 3, nil, []*RepeatableMigration{{Name: "R__t_view.sql", SQL: "CREATE OR REPLACE VIEW t_view AS SELECT * FROM t"}})
+	require.NoError(t, err)
+	require.Equal(t, `-- Dry run: schema_version 3 -> 3
+
+begin isolation level serializable;
+
+-- R__t_view.sql (repeatable)
+CREATE OR REPLACE VIEW t_view AS SELECT * FROM t;
+
+commit;
+`, buf.String())
+}
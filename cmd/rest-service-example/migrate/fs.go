@@ -0,0 +1,42 @@
+package migrate
+
+import (
+	"io/fs"
+	"os"
+)
+
+// fsMigratorFS adapts an fs.FS, e.g. an embed.FS, to MigratorFS
+type fsMigratorFS struct {
+	fsys fs.FS
+}
+
+// NewMigratorFS returns a MigratorFS reading migrations from fsys. Paths are
+// slash-separated and relative to the root of fsys, use "." for the root.
+func NewMigratorFS(fsys fs.FS) MigratorFS {
+	return fsMigratorFS{fsys: fsys}
+}
+
+func (f fsMigratorFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(f.fsys, dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		fileInfos = append(fileInfos, fi)
+	}
+	return fileInfos, nil
+}
+
+func (f fsMigratorFS) ReadFile(filename string) ([]byte, error) {
+	return fs.ReadFile(f.fsys, filename)
+}
+
+func (f fsMigratorFS) Glob(pattern string) ([]string, error) {
+	return fs.Glob(f.fsys, pattern)
+}
@@ -0,0 +1,33 @@
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigratorFS(t *testing.T) {
+	t.Parallel()
+
+	fsys := NewMigratorFS(fstest.MapFS{
+		"0001_create_t.sql":     {Data: []byte("CREATE TABLE t(id INT);\n---- create above / drop below ----\nDROP TABLE t;\n")},
+		"0002_create_u.sql":     {Data: []byte(`{{ template "shared/u.sql" . }}`)},
+		"shared/u.sql":          {Data: []byte("CREATE TABLE u(id INT);")},
+		"migrations.go":         {Data: []byte("package migrations")},
+		"README.md":             {Data: []byte("not a migration")},
+		"9999_unused/dummy.txt": {Data: []byte("")},
+	})
+
+	paths, err := FindMigrationsEx(".", fsys)
+	require.NoError(t, err)
+	require.Equal(t, []string{"0001_create_t.sql", "0002_create_u.sql"}, paths)
+
+	m := &Migrator{options: &MigratorOptions{MigratorFS: fsys}, Data: map[string]interface{}{}}
+	err = m.LoadMigrations(".")
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 2)
+	require.Equal(t, "CREATE TABLE t(id INT);", m.Migrations[0].UpSQL)
+	require.Equal(t, "DROP TABLE t;", m.Migrations[0].DownSQL)
+	require.Equal(t, "CREATE TABLE u(id INT);", m.Migrations[1].UpSQL)
+}
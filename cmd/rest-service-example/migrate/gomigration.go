@@ -0,0 +1,117 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// GoMigrationFunc is a step of a migration which can't be expressed in SQL,
+// e.g. a data migration requiring some logic. It's executed in the same
+// transaction as the version update.
+type GoMigrationFunc func(ctx context.Context, tx pgx.Tx) error
+
+// GoMigration takes the place of a migration file with the given sequence,
+// or the given version with TimestampVersioning. Down can be nil if the
+// migration is irreversible.
+type GoMigration struct {
+	Sequence int32
+	Version  int64
+	Name     string
+	Up       GoMigrationFunc
+	Down     GoMigrationFunc
+}
+
+// key returns the number of the migration according to the versioning
+func (g GoMigration) key(versioning Versioning) int64 {
+	if versioning == TimestampVersioning {
+		return g.Version
+	}
+	return int64(g.Sequence)
+}
+
+// RegisterGoMigration adds a Go migration. It should be called before
+// LoadMigrations, which places the Go migrations between the files according
+// to their sequences.
+func (m *Migrator) RegisterGoMigration(g GoMigration) error {
+	key := g.key(m.versioning())
+	if m.versioning() == TimestampVersioning {
+		if !isTimestamp(key) {
+			return fmt.Errorf("Invalid version %d of Go migration %s", key, g.Name)
+		}
+	} else if key < 1 {
+		return fmt.Errorf("Invalid sequence %d of Go migration %s", key, g.Name)
+	}
+
+	if g.Up == nil {
+		return fmt.Errorf("Go migration %d - %s has no Up function", key, g.Name)
+	}
+
+	if _, exists := m.goMigrations[key]; exists {
+		return fmt.Errorf("Duplicate migration %d", key)
+	}
+
+	if m.goMigrations == nil {
+		m.goMigrations = make(map[int64]GoMigration)
+	}
+	m.goMigrations[key] = g
+	return nil
+}
+
+func (m *Migrator) goSequences() map[int32]bool {
+	sequences := make(map[int32]bool, len(m.goMigrations))
+	for seq := range m.goMigrations {
+		sequences[int32(seq)] = true
+	}
+	return sequences
+}
+
+// appendGoMigration is AppendMigration for Go migrations. They always run
+// in a transaction and have no checksum.
+func (m *Migrator) appendGoMigration(g GoMigration) {
+	m.Migrations = append(
+		m.Migrations,
+		&Migration{
+			Sequence: int32(len(m.Migrations)) + 1,
+			Version:  g.key(m.versioning()),
+			Name:     g.Name,
+			Up:       g.Up,
+			Down:     g.Down,
+		})
+}
+
+// CountMigrations returns the number of migrations LoadMigrations would load,
+// i.e. the version of an up-to-date schema
+func CountMigrations(path string, fs MigratorFS, versioning Versioning, goMigrations []GoMigration) (int32, error) {
+	if versioning == TimestampVersioning {
+		goVersions := make(map[int64]bool, len(goMigrations))
+		for _, g := range goMigrations {
+			goVersions[g.Version] = true
+		}
+
+		files, err := findTimestampMigrations(path, fs, goVersions)
+		if err != nil {
+			return 0, err
+		}
+		return int32(len(files) + len(goVersions)), nil
+	}
+
+	goSequences := make(map[int32]bool, len(goMigrations))
+	for _, g := range goMigrations {
+		goSequences[g.Sequence] = true
+	}
+
+	paths, err := findMigrations(path, fs, goSequences)
+	if err != nil {
+		return 0, err
+	}
+
+	count := int32(len(paths) + len(goSequences))
+	for seq := range goSequences {
+		if seq > count {
+			return 0, fmt.Errorf("Missing migration before Go migration %d", seq)
+		}
+	}
+	return count, nil
+}
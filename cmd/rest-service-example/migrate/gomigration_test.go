@@ -0,0 +1,81 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoMigrations(t *testing.T) {
+	t.Parallel()
+
+	noop := func(ctx context.Context, tx pgx.Tx) error {
+		return nil
+	}
+	files := fstest.MapFS{
+		"0001_create_t.sql": {Data: []byte("CREATE TABLE t(id INT);")},
+		"0003_alter_t.sql":  {Data: []byte("ALTER TABLE t ADD COLUMN name TEXT;")},
+	}
+
+	cases := []struct {
+		goSequences []int32
+		names       []string
+		err         string
+	}{
+		{[]int32{2}, []string{"0001_create_t.sql", "go_2", "0003_alter_t.sql"}, ""},
+		{[]int32{2, 4}, []string{"0001_create_t.sql", "go_2", "0003_alter_t.sql", "go_4"}, ""},
+		{nil, nil, "Missing migration 2"},
+		{[]int32{3}, nil, "Migration 3 is defined both in SQL and in Go"},
+		{[]int32{2, 5}, nil, "Missing migration 4"},
+	}
+
+	for _, c := range cases {
+		m := &Migrator{options: &MigratorOptions{MigratorFS: NewMigratorFS(files)}, Data: map[string]interface{}{}}
+		var goMigrations []GoMigration
+		for _, seq := range c.goSequences {
+			g := GoMigration{Sequence: seq, Name: fmt.Sprintf("go_%d", seq), Up: noop}
+			goMigrations = append(goMigrations, g)
+			require.NoError(t, m.RegisterGoMigration(g))
+		}
+
+		err := m.LoadMigrations(".")
+		_, countErr := CountMigrations(".", m.options.MigratorFS, SequentialVersioning, goMigrations)
+		if c.err != "" {
+			require.EqualError(t, err, c.err, c.goSequences)
+			require.Error(t, countErr, c.goSequences)
+			continue
+		}
+
+		require.NoError(t, err, c.goSequences)
+		require.NoError(t, countErr, c.goSequences)
+		var names []string
+		for i, mig := range m.Migrations {
+			require.Equal(t, int32(i+1), mig.Sequence)
+			names = append(names, mig.Name)
+		}
+		require.Equal(t, c.names, names)
+	}
+}
+
+func TestRegisterGoMigration(t *testing.T) {
+	t.Parallel()
+
+	noop := func(ctx context.Context, tx pgx.Tx) error {
+		return nil
+	}
+	m := &Migrator{}
+	require.NoError(t, m.RegisterGoMigration(GoMigration{Sequence: 1, Name: "a", Up: noop}))
+	require.Error(t, m.RegisterGoMigration(GoMigration{Sequence: 1, Name: "b", Up: noop}))
+	require.Error(t, m.RegisterGoMigration(GoMigration{Sequence: 0, Name: "c", Up: noop}))
+	require.Error(t, m.RegisterGoMigration(GoMigration{Sequence: 2, Name: "d"}))
+
+	// Go migrations without Down are irreversible
+	m.appendGoMigration(GoMigration{Sequence: 1, Name: "a", Up: noop})
+	m.AppendMigration("0002_sql.sql", "SELECT 1", "SELECT 2")
+	_, err := m.plan(2, 0)
+	require.Equal(t, IrreversibleMigrationError{m: m.Migrations[0]}, err)
+}
@@ -0,0 +1,222 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ChecksumMismatchError means that a migration was changed after it had been
+// applied, so the schema may differ from what the migration files describe.
+type ChecksumMismatchError struct {
+	Version  int64
+	Name     string
+	Recorded string
+	Actual   string
+}
+
+func (e ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("Migration %d - %s was modified after it had been applied: recorded checksum %s, actual %s",
+		e.Version, e.Name, e.Recorded, e.Actual)
+}
+
+// checksum is a SHA-256 of the migration SQL after template rendering
+func checksum(sql string) string {
+	sum := sha256.Sum256([]byte(sql))
+	return hex.EncodeToString(sum[:])
+}
+
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+func (m *Migrator) historyTableName() string {
+	return m.versionTable + "_history"
+}
+
+// ensureHistoryTableExists creates a table with a row per applied migration.
+// applied_at, duration and host are NULL for the migrations which were applied
+// before the table existed. Rows are identified by version. With sequential
+// versioning sequence is the same as version, with timestamp versioning it's
+// the order in which the migrations were applied.
+func (m *Migrator) ensureHistoryTableExists(ctx context.Context) error {
+	_, err := m.conn.Exec(ctx, fmt.Sprintf(`
+    create table if not exists %s(
+      sequence int4 primary key,
+      version int8,
+      name text not null,
+      checksum text not null,
+      applied_at timestamptz,
+      duration interval,
+      host text
+    )
+  `, m.historyTableName()))
+	if err != nil {
+		return err
+	}
+
+	// The table could be created by a version which didn't have this column.
+	// Schema changes and writes are executed separately for CockroachDB.
+	stmts := []string{
+		"alter table %s add column if not exists version int8",
+		"update %s set version = sequence where version is null",
+		"create unique index if not exists %[1]s_version_idx on %[1]s(version)",
+	}
+	for _, stmt := range stmts {
+		_, err = m.conn.Exec(ctx, fmt.Sprintf(stmt, m.historyTableName()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillHistory adds the missing rows for the migrations applied before
+// the history table was introduced. Their checksums are taken from the
+// current files, so a change made before the upgrade can't be detected.
+func (m *Migrator) backfillHistory(ctx context.Context, currentVersion int32) error {
+	// The history is the only source of truth about applied migrations with
+	// timestamp versioning, nothing to backfill from
+	if m.timestampVersioning() {
+		return nil
+	}
+
+	for _, mig := range m.Migrations {
+		if mig.Sequence > currentVersion {
+			break
+		}
+
+		_, err := m.conn.Exec(ctx, fmt.Sprintf(`
+      insert into %s(sequence, version, name, checksum) values ($1, $2, $3, $4)
+      on conflict (sequence) do nothing
+    `, m.historyTableName()), mig.Sequence, mig.Version, mig.Name, mig.Checksum)
+		if err != nil {
+			return errors.Wrap(err, "Unable to backfill migration history")
+		}
+	}
+	return nil
+}
+
+// verifyChecksums compares checksums of the applied migrations with the
+// loaded ones. With AllowChecksumDrift a mismatch is reported to
+// OnChecksumMismatch instead of being returned as an error.
+func (m *Migrator) verifyChecksums(ctx context.Context) error {
+	rows, err := m.conn.Query(ctx, fmt.Sprintf("select version, checksum from %s order by version",
+		m.historyTableName()))
+	if err != nil {
+		return errors.Wrap(err, "Unable to read migration history")
+	}
+	defer rows.Close()
+
+	byVersion := m.migrationsByVersion()
+	var mismatches []ChecksumMismatchError
+	for rows.Next() {
+		var version int64
+		var recorded string
+		err = rows.Scan(&version, &recorded)
+		if err != nil {
+			return errors.Wrap(err, "Unable to read migration history")
+		}
+
+		// Unknown migrations are reported by the caller if necessary
+		mig, ok := byVersion[version]
+		if !ok {
+			continue
+		}
+
+		if mig.Checksum != recorded {
+			mismatches = append(mismatches, ChecksumMismatchError{
+				Version:  version,
+				Name:     mig.Name,
+				Recorded: recorded,
+				Actual:   mig.Checksum,
+			})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "Unable to read migration history")
+	}
+
+	for _, mismatch := range mismatches {
+		if !m.options.AllowChecksumDrift {
+			return mismatch
+		}
+		if m.OnChecksumMismatch != nil {
+			m.OnChecksumMismatch(mismatch)
+		}
+	}
+	return nil
+}
+
+// recordStep updates the history after a migration step. It's executed in
+// the same transaction as the step, if there is one.
+func (m *Migrator) recordStep(ctx context.Context, s step, duration time.Duration) error {
+	if s.direction != "up" {
+		_, err := m.conn.Exec(ctx, fmt.Sprintf("delete from %s where version = $1", m.historyTableName()),
+			s.migration.Version)
+		return errors.Wrap(err, "Unable to update migration history")
+	}
+
+	var sequence interface{} = s.migration.Sequence
+	if m.timestampVersioning() {
+		// Positions of the migrations change when an out of order one is
+		// applied, so the order of application is recorded instead
+		sequence = nil
+	}
+
+	_, err := m.conn.Exec(ctx, fmt.Sprintf(`
+      insert into %[1]s(sequence, version, name, checksum, applied_at, duration, host)
+      select coalesce($1::int4, (select coalesce(max(sequence), 0) + 1 from %[1]s)), $2, $3, $4, now(), $5, $6
+      on conflict (version) do update set name = excluded.name, checksum = excluded.checksum,
+        applied_at = excluded.applied_at, duration = excluded.duration, host = excluded.host
+    `, m.historyTableName()),
+		sequence, s.migration.Version, s.migration.Name, s.migration.Checksum, duration, m.host)
+	return errors.Wrap(err, "Unable to update migration history")
+}
+
+// HistoryEntry is a row of the history table. AppliedAt, Duration and Host
+// are nil for the migrations applied before the history was introduced.
+type HistoryEntry struct {
+	Sequence  int32
+	Version   int64
+	Name      string
+	Checksum  string
+	AppliedAt *time.Time
+	Duration  *time.Duration
+	Host      *string
+}
+
+// History returns the applied migrations ordered by sequence
+func (m *Migrator) History(ctx context.Context) ([]HistoryEntry, error) {
+	rows, err := m.conn.Query(ctx, fmt.Sprintf(
+		"select sequence, version, name, checksum, applied_at, duration, host from %s order by sequence",
+		m.historyTableName()))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read migration history")
+	}
+	defer rows.Close()
+
+	var history []HistoryEntry
+	for rows.Next() {
+		var e HistoryEntry
+		err = rows.Scan(&e.Sequence, &e.Version, &e.Name, &e.Checksum, &e.AppliedAt, &e.Duration, &e.Host)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to read migration history")
+		}
+		history = append(history, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Unable to read migration history")
+	}
+	return history, nil
+}
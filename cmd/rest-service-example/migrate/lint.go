@@ -0,0 +1,310 @@
+package migrate
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Lint rules. The names are used in suppression comments, e.g.:
+//
+//	-- lint:ignore drop-column the column is unused since v1.2
+//	ALTER TABLE phonebook DROP COLUMN legacy_phone;
+//
+// A comment suppresses the listed rules (comma-separated) for the statement
+// which follows it. missing-down is suppressed by a comment anywhere in the
+// forward part of the migration.
+const (
+	LintNotNullWithoutDefault = "not-null-without-default"
+	LintDropColumn            = "drop-column"
+	LintDropTable             = "drop-table"
+	LintIndexNotConcurrent    = "index-not-concurrent"
+	LintTypeNarrowing         = "type-narrowing"
+	LintMissingDown           = "missing-down"
+)
+
+var lintIgnoreDirective = regexp.MustCompile(`\Alint:ignore\s+([\w,-]+)`)
+
+// The patterns are matched against statements without comments, in lower
+// case and with whitespace collapsed
+var (
+	lintAlterTable   = regexp.MustCompile(`\Aalter table (?:if exists )?(?:only )?(\S+) (.+)\z`)
+	lintAddColumn    = regexp.MustCompile(`\Aadd (?:column )?(?:if not exists )?(\S+) (.+)\z`)
+	lintDropColumn   = regexp.MustCompile(`\Adrop (?:column )?(?:if exists )?(\S+)`)
+	lintAlterType    = regexp.MustCompile(`\Aalter (?:column )?(\S+) (?:set data )?type (.+)\z`)
+	lintRenameColumn = regexp.MustCompile(`\Arename (?:column )?(\S+) to (\S+)\z`)
+	lintCreateTable  = regexp.MustCompile(`\Acreate (?:(?:temp|temporary|unlogged) )?table (?:if not exists )?([^\s(]+) ?\((.*)\)`)
+	lintDropTable    = regexp.MustCompile(`\Adrop table (?:if exists )?([^\s,]+)`)
+	lintCreateIndex  = regexp.MustCompile(`\Acreate (?:unique )?index (concurrently )?.*?\bon (?:only )?([^\s(]+)`)
+	lintNotNull      = regexp.MustCompile(`\bnot null\b`)
+	lintDefault      = regexp.MustCompile(`\b(?:default|generated)\b`)
+	lintTypeEnd      = regexp.MustCompile(`\s(?:not|null|default|primary|references|unique|check|constraint|collate|generated|using)\b`)
+)
+
+// constraintKeywords start table constraints rather than column definitions
+var constraintKeywords = map[string]bool{
+	"constraint": true, "primary": true, "unique": true, "foreign": true, "check": true, "exclude": true,
+}
+
+var typeAliases = map[string]string{
+	"int": "int4", "integer": "int4", "serial": "int4", "serial4": "int4",
+	"bigint": "int8", "bigserial": "int8", "serial8": "int8",
+	"smallint": "int2", "smallserial": "int2", "serial2": "int2",
+	"decimal": "numeric", "string": "text",
+}
+
+var intRanks = map[string]int{"int2": 1, "int4": 2, "int8": 3}
+
+// LintFinding is a potentially dangerous part of a migration
+type LintFinding struct {
+	Version   int64
+	Migration string
+	Rule      string
+	Message   string
+	// Statement is empty for the findings about the whole migration
+	Statement string
+}
+
+func (f LintFinding) String() string {
+	if f.Statement == "" {
+		return fmt.Sprintf("%s: %s: %s", f.Migration, f.Rule, f.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s\n\t%s", f.Migration, f.Rule, f.Message, f.Statement)
+}
+
+// linter keeps track of the schema described by the migrations, so that
+// a statement can be checked against the ones before it
+type linter struct {
+	// columns maps table.column to the normalized type
+	columns map[string]string
+	// created contains the tables created by the current migration
+	created  map[string]bool
+	findings []LintFinding
+	// CockroachDB builds indexes online and has no CREATE INDEX CONCURRENTLY
+	cockroachDB bool
+}
+
+// Lint checks the forward parts of the SQL migrations for statements which
+// can break a running service or fail on a large table. Go migrations are
+// skipped. The migrations should be rendered for the DBMS given by
+// cockroachDB, some rules apply only to PostgreSQL.
+func Lint(migrations []*Migration, cockroachDB bool) []LintFinding {
+	l := &linter{columns: make(map[string]string), cockroachDB: cockroachDB}
+	for _, mig := range migrations {
+		if mig.Up != nil {
+			continue
+		}
+
+		l.created = make(map[string]bool)
+		for _, stmt := range splitStatements(mig.UpSQL) {
+			l.lintStatement(mig, stmt)
+		}
+
+		_, comments := stripComments(mig.UpSQL)
+		if !containsSQL(mig.DownSQL) && !ignoredRules(comments)[LintMissingDown] {
+			l.findings = append(l.findings, LintFinding{
+				Version:   mig.Version,
+				Migration: mig.Name,
+				Rule:      LintMissingDown,
+				Message:   "There is no down section, rolling back will fail with IrreversibleMigrationError",
+			})
+		}
+	}
+	return l.findings
+}
+
+func (l *linter) lintStatement(mig *Migration, stmt string) {
+	sql, comments := stripComments(stmt)
+	sql = strings.Join(strings.Fields(sql), " ")
+	lower := strings.ToLower(sql)
+	ignored := ignoredRules(comments)
+
+	report := func(rule, message string) {
+		if ignored[rule] {
+			return
+		}
+		l.findings = append(l.findings, LintFinding{
+			Version:   mig.Version,
+			Migration: mig.Name,
+			Rule:      rule,
+			Message:   message,
+			Statement: sql,
+		})
+	}
+
+	if matches := lintCreateTable.FindStringSubmatch(lower); matches != nil {
+		table := unquote(matches[1])
+		l.created[table] = true
+		for _, def := range splitTopLevel(matches[2]) {
+			fields := strings.SplitN(def, " ", 2)
+			if len(fields) == 2 && !constraintKeywords[fields[0]] {
+				l.columns[table+"."+unquote(fields[0])] = columnType(fields[1])
+			}
+		}
+		return
+	}
+
+	if matches := lintDropTable.FindStringSubmatch(lower); matches != nil {
+		report(LintDropTable, "Dropping a table breaks the instances still running the previous version")
+		return
+	}
+
+	if matches := lintCreateIndex.FindStringSubmatch(lower); matches != nil {
+		// An index on a table created by the same migration is built instantly
+		if matches[1] == "" && !l.created[unquote(matches[2])] && !l.cockroachDB {
+			report(LintIndexNotConcurrent, "Creating an index without CONCURRENTLY blocks writes to the table, "+
+				"use CREATE INDEX CONCURRENTLY in a migrate:tx=none migration")
+		}
+		return
+	}
+
+	matches := lintAlterTable.FindStringSubmatch(lower)
+	if matches == nil {
+		return
+	}
+
+	table := unquote(matches[1])
+	for _, action := range splitTopLevel(matches[2]) {
+		if m := lintAddColumn.FindStringSubmatch(action); m != nil && !constraintKeywords[m[1]] {
+			l.columns[table+"."+unquote(m[1])] = columnType(m[2])
+			if lintNotNull.MatchString(m[2]) && !lintDefault.MatchString(m[2]) {
+				report(LintNotNullWithoutDefault, "Adding a NOT NULL column without a default fails "+
+					"if the table has rows")
+			}
+		} else if m := lintDropColumn.FindStringSubmatch(action); m != nil && !constraintKeywords[m[1]] {
+			delete(l.columns, table+"."+unquote(m[1]))
+			report(LintDropColumn, "Dropping a column breaks the instances still running the previous version")
+		} else if m := lintAlterType.FindStringSubmatch(action); m != nil {
+			column := table + "." + unquote(m[1])
+			newType := columnType(m[2])
+			if oldType, ok := l.columns[column]; ok && narrowing(oldType, newType) {
+				report(LintTypeNarrowing, fmt.Sprintf("Changing the type of %s from %s to %s "+
+					"fails or truncates the existing values", column, oldType, newType))
+			}
+			l.columns[column] = newType
+		} else if m := lintRenameColumn.FindStringSubmatch(action); m != nil {
+			oldColumn := table + "." + unquote(m[1])
+			if t, ok := l.columns[oldColumn]; ok {
+				delete(l.columns, oldColumn)
+				l.columns[table+"."+unquote(m[2])] = t
+			}
+		}
+	}
+}
+
+// ignoredRules returns the rules suppressed by lint:ignore comments
+func ignoredRules(comments []string) map[string]bool {
+	ignored := make(map[string]bool)
+	for _, c := range comments {
+		matches := lintIgnoreDirective.FindStringSubmatch(c)
+		if matches == nil {
+			continue
+		}
+		for _, rule := range strings.Split(matches[1], ",") {
+			ignored[rule] = true
+		}
+	}
+	return ignored
+}
+
+// splitTopLevel splits a list of column definitions or ALTER TABLE actions
+// by the commas outside of parentheses and quotes
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth := 0
+	start := 0
+	i := 0
+	for i < len(s) {
+		switch s[i] {
+		case '\'', '"':
+			i = skipQuoted(s, i, s[i])
+			continue
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+		i++
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+func unquote(identifier string) string {
+	return strings.ReplaceAll(identifier, `"`, "")
+}
+
+// columnType returns the normalized type from a column definition, e.g.
+// int4 for "integer not null" and varchar(64) for "character varying (64)"
+func columnType(def string) string {
+	if loc := lintTypeEnd.FindStringIndex(def); loc != nil {
+		def = def[:loc[0]]
+	}
+	t := strings.TrimSpace(def)
+	t = strings.Replace(t, "character varying", "varchar", 1)
+	t = strings.Replace(t, "character", "char", 1)
+	t = strings.ReplaceAll(t, " ", "")
+	if alias, ok := typeAliases[t]; ok {
+		return alias
+	}
+	return t
+}
+
+// splitType returns the name and the numeric parameters of a type, e.g.
+// numeric and [10 2] for numeric(10,2)
+func splitType(t string) (string, []int) {
+	open := strings.IndexByte(t, '(')
+	if open < 0 || !strings.HasSuffix(t, ")") {
+		return t, nil
+	}
+
+	var params []int
+	for _, p := range strings.Split(t[open+1:len(t)-1], ",") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return t, nil
+		}
+		params = append(params, n)
+	}
+	return t[:open], params
+}
+
+// narrowing reports whether some values of oldType don't fit into newType
+func narrowing(oldType, newType string) bool {
+	oldName, oldParams := splitType(oldType)
+	newName, newParams := splitType(newType)
+
+	switch {
+	case intRanks[oldName] > 0 && intRanks[newName] > 0:
+		return intRanks[newName] < intRanks[oldName]
+	case (oldName == "text" || oldName == "varchar" || oldName == "char") && (newName == "varchar" || newName == "char"):
+		// No limit means unlimited length, except for char which is char(1)
+		if newName == "char" && len(newParams) == 0 {
+			newParams = []int{1}
+		}
+		if oldName == "char" && len(oldParams) == 0 {
+			oldParams = []int{1}
+		}
+		if len(newParams) == 0 {
+			return false
+		}
+		return len(oldParams) == 0 || newParams[0] < oldParams[0]
+	case oldName == "numeric" && newName == "numeric":
+		if len(newParams) == 0 {
+			return false
+		}
+		if len(oldParams) == 0 {
+			return true
+		}
+		// Scale is zero if omitted
+		oldParams = append(oldParams, 0)
+		newParams = append(newParams, 0)
+		return newParams[0] < oldParams[0] || newParams[1] < oldParams[1]
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package migrate
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLint(t *testing.T) {
+	t.Parallel()
+
+	const createTable = "CREATE TABLE t(id SERIAL PRIMARY KEY, name VARCHAR(64) NOT NULL, " +
+		"amount NUMERIC(10, 2), n INTEGER, CONSTRAINT t_name_uniq UNIQUE (name));\n"
+
+	cases := []struct {
+		upSQL   string
+		downSQL string
+		rules   []string
+	}{
+		{createTable, "DROP TABLE t;", nil},
+		{createTable + "CREATE INDEX t_name_idx ON t(name);", "DROP TABLE t;", nil},
+		{createTable, "", []string{LintMissingDown}},
+		{createTable + "-- lint:ignore missing-down the data can't be restored\n", "", nil},
+		{createTable, "-- Only a comment\n", []string{LintMissingDown}},
+		{createTable + "ALTER TABLE t ADD COLUMN phone TEXT NOT NULL;", "x", []string{LintNotNullWithoutDefault}},
+		{createTable + "ALTER TABLE t ADD phone TEXT NOT NULL DEFAULT '';", "x", nil},
+		{createTable + "ALTER TABLE t ADD COLUMN phone TEXT, ADD CONSTRAINT c CHECK (n IS NOT NULL);", "x", nil},
+		{createTable + "ALTER TABLE t DROP COLUMN name;", "x", []string{LintDropColumn}},
+		{createTable + "ALTER TABLE t DROP CONSTRAINT t_name_uniq;", "x", nil},
+		{createTable + "-- lint:ignore drop-column,drop-table\nALTER TABLE t DROP name;", "x", nil},
+		{createTable + "-- lint:ignore drop-column\nSELECT 1;\nALTER TABLE t DROP name;", "x", []string{LintDropColumn}},
+		{createTable + "DROP TABLE IF EXISTS t;", "x", []string{LintDropTable}},
+		{"CREATE INDEX t_name_idx ON t USING btree (name);", "x", []string{LintIndexNotConcurrent}},
+		{"CREATE UNIQUE INDEX IF NOT EXISTS t_name_idx ON ONLY \"t\" (name);", "x", []string{LintIndexNotConcurrent}},
+		{"CREATE INDEX CONCURRENTLY t_name_idx ON t(name);", "x", nil},
+		{"-- CREATE INDEX i ON t(name);\nSELECT 'CREATE INDEX i ON t(name)';", "x", nil},
+		{createTable + "ALTER TABLE t ALTER COLUMN name TYPE VARCHAR(32);", "x", []string{LintTypeNarrowing}},
+		{createTable + "ALTER TABLE t ALTER name SET DATA TYPE character varying (128);", "x", nil},
+		{createTable + "ALTER TABLE t ALTER COLUMN name TYPE TEXT;", "x", nil},
+		{createTable + "ALTER TABLE t ALTER COLUMN n TYPE smallint USING n::smallint;", "x", []string{LintTypeNarrowing}},
+		{createTable + "ALTER TABLE t ALTER COLUMN n TYPE bigint;", "x", nil},
+		{createTable + "ALTER TABLE t ALTER COLUMN amount TYPE numeric(12, 1);", "x", []string{LintTypeNarrowing}},
+		{createTable + "ALTER TABLE t RENAME COLUMN name TO title;\nALTER TABLE t ALTER title TYPE varchar(8);", "x",
+			[]string{LintTypeNarrowing}},
+		{"ALTER TABLE unknown ALTER COLUMN name TYPE varchar(8);", "x", nil},
+	}
+
+	for _, c := range cases {
+		m := &Migrator{}
+		m.AppendMigration("0001_test.sql", c.upSQL, c.downSQL)
+		var rules []string
+		for _, f := range Lint(m.Migrations, false) {
+			require.Equal(t, "0001_test.sql", f.Migration)
+			require.Equal(t, int64(1), f.Version)
+			rules = append(rules, f.Rule)
+		}
+		require.Equal(t, c.rules, rules, c.upSQL)
+	}
+}
+
+func TestLintAcrossMigrations(t *testing.T) {
+	t.Parallel()
+
+	m := &Migrator{}
+	m.AppendMigration("0001_create_t.sql", "CREATE TABLE t(id INT, name VARCHAR(64));", "DROP TABLE t;")
+	m.appendGoMigration(GoMigration{Sequence: 2, Name: "go_migration", Up: func(ctx context.Context, tx pgx.Tx) error {
+		return nil
+	}})
+	m.AppendMigration("0003_index_t.sql", "CREATE INDEX t_name_idx ON t(name);\n"+
+		"ALTER TABLE t ALTER COLUMN name TYPE VARCHAR(16);", "DROP INDEX t_name_idx;")
+
+	findings := Lint(m.Migrations, false)
+	require.Len(t, findings, 2)
+	require.Equal(t, LintIndexNotConcurrent, findings[0].Rule)
+	require.Equal(t, "CREATE INDEX t_name_idx ON t(name)", findings[0].Statement)
+	require.Equal(t, LintTypeNarrowing, findings[1].Rule)
+	require.Equal(t, int64(3), findings[1].Version)
+}
+
+func TestNarrowing(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		oldType, newType string
+		narrowing        bool
+	}{
+		{"varchar(64)", "varchar(32)", true},
+		{"varchar(64)", "varchar(64)", false},
+		{"varchar", "varchar(64)", true},
+		{"text", "char", true},
+		{"char", "varchar(2)", false},
+		{"varchar(64)", "text", false},
+		{"int8", "int4", true},
+		{"int2", "int4", false},
+		{"numeric", "numeric(10,2)", true},
+		{"numeric(10,2)", "numeric(10)", true},
+		{"numeric(10)", "numeric(12,2)", false},
+		{"text", "jsonb", false},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.narrowing, narrowing(c.oldType, c.newType), "%s -> %s", c.oldType, c.newType)
+	}
+}
+
+func TestLintCockroachDB(t *testing.T) {
+	t.Parallel()
+
+	files := fstest.MapFS{
+		"0001_create_t.sql": {Data: []byte("CREATE TABLE t(id INT, name TEXT);\n" + Separator + "\nDROP TABLE t;")},
+		"0002_index_t.sql": {Data: []byte("-- migrate:tx=none\n{{if .CockroachDB}}CREATE INDEX t_name_idx ON t(name);" +
+			"{{else}}CREATE INDEX CONCURRENTLY t_name_idx ON t(name);{{end}}\n" + Separator + "\nDROP INDEX t_name_idx;")},
+	}
+
+	// CockroachDB builds indexes online
+	for _, cockroachDB := range []bool{false, true} {
+		m := &Migrator{options: &MigratorOptions{MigratorFS: NewMigratorFS(files)}, Data: map[string]interface{}{
+			"CockroachDB": cockroachDB,
+		}}
+		err := m.LoadMigrations(".")
+		require.NoError(t, err)
+		require.Empty(t, Lint(m.Migrations, cockroachDB), "cockroachDB = %v", cockroachDB)
+	}
+
+	// Other rules still apply
+	m := &Migrator{}
+	m.AppendMigration("0001_drop_t.sql", "DROP TABLE t;", "")
+	var rules []string
+	for _, f := range Lint(m.Migrations, true) {
+		rules = append(rules, f.Rule)
+	}
+	require.Equal(t, []string{LintDropTable, LintMissingDown}, rules)
+}
@@ -0,0 +1,265 @@
+package migrate
+
+// Cluster-wide lock which makes sure only one replica runs migrations at
+// a time. PostgreSQL provides advisory locks for this. CockroachDB doesn't
+// support them, so a row in a lock table is used instead. The row has an
+// expiration time, so a crashed replica doesn't block migrations forever.
+// While the lock is held the expiration time is extended by a heartbeat,
+// so the migrations can take longer than the TTL.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultLockTimeout = time.Minute
+	DefaultLockTTL     = 15 * time.Minute
+
+	lockRetryInterval = 500 * time.Millisecond
+	unlockTimeout     = 10 * time.Second
+
+	lockTableAttempts   = 3
+	lockTableRetryDelay = 100 * time.Millisecond
+)
+
+type LockTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e LockTimeoutError) Error() string {
+	return fmt.Sprintf("Unable to acquire the migration lock in %v, is another replica migrating?", e.Timeout)
+}
+
+// LockLostError means that the lock wasn't renewed in time and could be
+// taken by another replica. The migrations are interrupted then.
+type LockLostError struct {
+	TTL time.Duration
+}
+
+func (e LockLostError) Error() string {
+	return fmt.Sprintf("The migration lock was not renewed in %v and could be taken by another replica, "+
+		"the migration was interrupted", e.TTL)
+}
+
+// heartbeat extends the expiration time of the lock on CockroachDB
+type heartbeat struct {
+	stop chan struct{}
+	done chan struct{}
+	// err is set before done is closed
+	err error
+}
+
+func (m *Migrator) lockTableName() string {
+	return m.versionTable + "_lock"
+}
+
+// advisoryLockKey derives a lock key from the version table name, so that
+// different migrators in the same database don't block each other
+func (m *Migrator) advisoryLockKey() int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("migrate:" + m.versionTable))
+	return int64(h.Sum64())
+}
+
+func newLockOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), hex.EncodeToString(buf))
+}
+
+func (m *Migrator) ensureLockTableExists(ctx context.Context) (err error) {
+	if !m.cockroachDB {
+		return nil
+	}
+
+	// Nothing protects this table from being created by several replicas
+	// at once, so a conflict is possible. The next attempt will find the
+	// table created by another replica.
+	delay := lockTableRetryDelay
+	for attempt := 1; ; attempt++ {
+		_, err = m.conn.Exec(ctx, fmt.Sprintf(`
+      create table if not exists %s(id int4 primary key, owner text not null, expires_at timestamptz not null)
+    `, m.lockTableName()))
+		if err == nil || attempt == lockTableAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (m *Migrator) lockTTL() time.Duration {
+	if m.options.LockTTL <= 0 {
+		return DefaultLockTTL
+	}
+	return m.options.LockTTL
+}
+
+// lock waits up to MigratorOptions.LockTimeout for the migration lock. The
+// returned context is canceled if the lock is lost, it should be used for
+// the work done under the lock.
+func (m *Migrator) lock(ctx context.Context) (context.Context, error) {
+	timeout := m.options.LockTimeout
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		acquired, err := m.tryLock(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to acquire the migration lock")
+		}
+		if acquired {
+			break
+		}
+
+		if time.Now().Add(lockRetryInterval).After(deadline) {
+			return nil, LockTimeoutError{Timeout: timeout}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+
+	if !m.cockroachDB || m.options.AcquireLockConn == nil {
+		return ctx, nil
+	}
+
+	// The migrator's connection is busy with the migrations. A pool can be
+	// exhausted, so the wait is limited.
+	acquireCtx, cancel := context.WithTimeout(ctx, timeout)
+	conn, release, err := m.options.AcquireLockConn(acquireCtx)
+	cancel()
+	if err != nil {
+		_ = m.unlock()
+		return nil, errors.Wrap(err, "Unable to acquire a connection for renewing the migration lock")
+	}
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	m.heartbeat = &heartbeat{stop: make(chan struct{}), done: make(chan struct{})}
+	go func(hb *heartbeat) {
+		defer close(hb.done)
+		defer release()
+		// Interrupts the migrations if the lock is lost
+		defer cancel()
+		hb.err = m.renewLock(conn, hb.stop)
+	}(m.heartbeat)
+	return lockCtx, nil
+}
+
+// renewLock extends the expiration time of the lock three times per TTL
+// until stop is closed. Failed attempts are retried until the lock expires.
+func (m *Migrator) renewLock(conn *pgx.Conn, stop chan struct{}) error {
+	ttl := m.lockTTL()
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), ttl/3)
+		ct, err := conn.Exec(ctx, fmt.Sprintf(`
+      update %s set expires_at = now() + $2 * interval '1 second' where id = 1 and owner = $1
+    `, m.lockTableName()), m.lockOwner, int64(ttl.Seconds()))
+		cancel()
+
+		switch {
+		case err == nil && ct.RowsAffected() == 1:
+			renewed = time.Now()
+		case err == nil || time.Since(renewed) >= ttl:
+			// Either the row was taken by another replica or it has expired
+			return LockLostError{TTL: ttl}
+		}
+	}
+}
+
+func (m *Migrator) tryLock(ctx context.Context) (acquired bool, err error) {
+	if !m.cockroachDB {
+		err = m.conn.QueryRow(ctx, "select pg_try_advisory_lock($1)", m.advisoryLockKey()).Scan(&acquired)
+		return acquired, err
+	}
+
+	ttl := m.lockTTL()
+
+	// Either there is no lock, or it has expired
+	ct, err := m.conn.Exec(ctx, fmt.Sprintf(`
+    insert into %s(id, owner, expires_at) values (1, $1, now() + $2 * interval '1 second')
+    on conflict (id) do update set owner = excluded.owner, expires_at = excluded.expires_at
+    where %s.expires_at < now()
+  `, m.lockTableName(), m.lockTableName()), m.lockOwner, int64(ttl.Seconds()))
+	if err != nil {
+		return false, err
+	}
+	return ct.RowsAffected() == 1, nil
+}
+
+// unlock releases the lock. It uses its own context, since the lock should
+// be released even if the migration was interrupted. LockLostError is
+// returned if the heartbeat failed to renew the lock.
+func (m *Migrator) unlock() error {
+	ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+	defer cancel()
+
+	if m.heartbeat != nil {
+		close(m.heartbeat.stop)
+		<-m.heartbeat.done
+		hbErr := m.heartbeat.err
+		m.heartbeat = nil
+		if hbErr != nil {
+			// The row is not ours anymore or will be taken over as expired
+			return hbErr
+		}
+	}
+
+	if !m.cockroachDB {
+		_, err := m.conn.Exec(ctx, "select pg_advisory_unlock($1)", m.advisoryLockKey())
+		return err
+	}
+
+	_, err := m.conn.Exec(ctx,
+		fmt.Sprintf("delete from %s where id = 1 and owner = $1", m.lockTableName()),
+		m.lockOwner)
+	return err
+}
+
+// unlockWith releases the lock after the work done under it finished with
+// err. A lost lock is reported instead of err, which is most likely
+// a canceled context then.
+func (m *Migrator) unlockWith(err error) error {
+	unlockErr := m.unlock()
+	if _, lost := unlockErr.(LockLostError); lost {
+		return unlockErr
+	}
+	if err == nil && unlockErr != nil {
+		return errors.Wrap(unlockErr, "Unable to release the migration lock")
+	}
+	return err
+}
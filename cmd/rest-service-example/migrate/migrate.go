@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/pkg/errors"
@@ -21,6 +22,9 @@ import (
 
 var migrationPattern = regexp.MustCompile(`\A(\d+)_.+\.sql\z`)
 
+// Separator splits a migration file into the forward and the rollback parts
+const Separator = "---- create above / drop below ----"
+
 var ErrNoFwMigration = errors.Errorf("no sql in forward migration step")
 
 type BadVersionError string
@@ -34,7 +38,39 @@ type IrreversibleMigrationError struct {
 }
 
 func (e IrreversibleMigrationError) Error() string {
-	return fmt.Sprintf("Irreversible migration: %d - %s", e.m.Sequence, e.m.Name)
+	return fmt.Sprintf("Irreversible migration: %d - %s", e.m.Version, e.m.Name)
+}
+
+// DirtyError means that a TxNone migration failed in the middle. The schema
+// has to be fixed manually, after that the dirty flag can be reset.
+type DirtyError struct {
+	Version      int32
+	versionTable string
+}
+
+func (e DirtyError) Error() string {
+	return fmt.Sprintf("Schema is dirty: a no-transaction migration after version %d was partially applied. "+
+		"Fix the schema manually, then run `update %s set dirty = false`", e.Version, e.versionTable)
+}
+
+// SchemaTooNewError means that the schema was migrated by a newer version
+// of the service. Migrate doesn't roll such a schema back.
+type SchemaTooNewError struct {
+	Version int32
+	Latest  int32
+}
+
+func (e SchemaTooNewError) Error() string {
+	return fmt.Sprintf("Schema version %d is newer than the latest known migration %d", e.Version, e.Latest)
+}
+
+type BadTxModeError struct {
+	Name string
+	Mode string
+}
+
+func (e BadTxModeError) Error() string {
+	return fmt.Sprintf("Unknown transaction mode %q in %s, expected one of: single, own, none", e.Mode, e.Name)
 }
 
 type NoMigrationsFoundError struct {
@@ -45,39 +81,186 @@ func (e NoMigrationsFoundError) Error() string {
 	return fmt.Sprintf("No migrations found at %s", e.Path)
 }
 
+// TxMode defines how a migration is wrapped into transactions. It's set by
+// a directive in the header of the migration file, e.g.:
+//
+//	-- migrate:tx=none
+//	CREATE INDEX CONCURRENTLY ...
+type TxMode int
+
+const (
+	// TxSingle migrations are executed in one transaction together with
+	// the adjacent TxSingle migrations. This is the default.
+	TxSingle TxMode = iota
+	// TxOwn migrations are executed in a separate transaction
+	TxOwn
+	// TxNone migrations are executed statement by statement without an
+	// explicit transaction. The schema is marked dirty while it's running.
+	TxNone
+)
+
+var txModeDirective = regexp.MustCompile(`\A--\s*migrate:tx=(\S*)\z`)
+
 type Migration struct {
+	// Sequence is the position of the migration, starting from 1
 	Sequence int32
-	Name     string
-	UpSQL    string
-	DownSQL  string
+	// Version is the number in the file name. It's the same as Sequence
+	// with SequentialVersioning.
+	Version int64
+	Name    string
+	UpSQL   string
+	DownSQL string
+	TxMode  TxMode
+	// Checksum is a SHA-256 of UpSQL, recorded in the history table. UpSQL
+	// is rendered, so changing Migrator.Data used by an applied migration
+	// is a drift as well.
+	Checksum string
+	// Up and Down are set instead of UpSQL and DownSQL for Go migrations
+	Up   GoMigrationFunc
+	Down GoMigrationFunc
 }
 
 type MigratorOptions struct {
 	// MigratorFS is the interface used for collecting the migrations.
 	MigratorFS MigratorFS
+	// LockTimeout is how long to wait for another replica to finish migrating.
+	// DefaultLockTimeout is used if it's zero.
+	LockTimeout time.Duration
+	// LockTTL is used only on CockroachDB. A lock which wasn't renewed for
+	// that long is considered stale, e.g. left by a crashed replica.
+	// DefaultLockTTL is used if it's zero.
+	LockTTL time.Duration
+	// AcquireLockConn returns a connection for renewing the lock on
+	// CockroachDB while migrating, e.g. from a pool, and a function which
+	// releases it. Without it the lock is not renewed and LockTTL should be
+	// longer than any migration.
+	AcquireLockConn func(ctx context.Context) (conn *pgx.Conn, release func(), err error)
+	// AllowChecksumDrift makes the migrator proceed when an applied migration
+	// was modified. Mismatches are reported to Migrator.OnChecksumMismatch.
+	AllowChecksumDrift bool
+	// Versioning defines how the migration files are numbered
+	Versioning Versioning
+	// AllowOutOfOrder makes the migrator apply pending migrations which are
+	// older than the last applied one instead of returning OutOfOrderError.
+	// It's used only with TimestampVersioning.
+	AllowOutOfOrder bool
 }
 
 type Migrator struct {
 	conn         *pgx.Conn
 	versionTable string
 	options      *MigratorOptions
+	cockroachDB  bool
+	lockOwner    string
+	heartbeat    *heartbeat
+	host         string
+	goMigrations map[int64]GoMigration
 	Migrations   []*Migration
-	OnStart      func(int32, string, string, string) // OnStart is called when a migration is run with the sequence, name, direction, and SQL
-	Data         map[string]interface{}              // Data available to use in migrations
+	Repeatables  []*RepeatableMigration
+	OnStart      func(int32, string, string, string) // OnStart is called when a migration is run with the sequence, name, direction, and SQL. The sequence is 0 and the direction is "repeatable" for RepeatableMigration.
+	Data         map[string]interface{}              // Data available to use in migrations, a missing key is an error
+
+	// OnChecksumMismatch is called for every modified migration if
+	// AllowChecksumDrift is set
+	OnChecksumMismatch func(ChecksumMismatchError)
 }
 
-func NewMigrator(conn *pgx.Conn, versionTable string) (m *Migrator, err error) {
-	return NewMigratorEx(conn, versionTable, &MigratorOptions{MigratorFS: defaultMigratorFS{}})
+func NewMigrator(ctx context.Context, conn *pgx.Conn, versionTable string) (m *Migrator, err error) {
+	return NewMigratorEx(ctx, conn, versionTable, &MigratorOptions{MigratorFS: defaultMigratorFS{}})
+}
+
+func NewMigratorEx(ctx context.Context, conn *pgx.Conn, versionTable string, opts *MigratorOptions) (m *Migrator, err error) {
+	m = NewOfflineMigrator(opts)
+	m.conn = conn
+	m.versionTable = versionTable
+	m.lockOwner = newLockOwner()
+	m.host = hostname()
+
+	m.cockroachDB, err = IsCockroachDB(ctx, conn)
+	if err != nil {
+		return
+	}
+
+	err = m.ensureLockTableExists(ctx)
+	if err != nil {
+		return
+	}
+
+	// Replicas starting at the same time could create the version table
+	// or insert the initial version concurrently
+	lockCtx, err := m.lock(ctx)
+	if err != nil {
+		return
+	}
+	err = m.ensureSchemaVersionTableExists(lockCtx)
+	if err == nil {
+		err = m.ensureHistoryTableExists(lockCtx)
+	}
+	if err == nil {
+		err = m.ensureRepeatableTableExists(lockCtx)
+	}
+	err = m.unlockWith(err)
+	return
 }
 
-func NewMigratorEx(conn *pgx.Conn, versionTable string, opts *MigratorOptions) (m *Migrator, err error) {
-	m = &Migrator{conn: conn, versionTable: versionTable, options: opts}
-	err = m.ensureSchemaVersionTableExists()
-	m.Migrations = make([]*Migration, 0)
-	m.Data = make(map[string]interface{})
+// NewReadOnlyMigrator creates a migrator which doesn't create its tables, e.g.
+// for reporting the status. It can only read the state, and only if
+// Initialized reports true.
+func NewReadOnlyMigrator(ctx context.Context, conn *pgx.Conn, versionTable string, opts *MigratorOptions) (m *Migrator,
+	err error) {
+	m = NewOfflineMigrator(opts)
+	m.conn = conn
+	m.versionTable = versionTable
+
+	m.cockroachDB, err = IsCockroachDB(ctx, conn)
 	return
 }
 
+// Initialized reports whether the tables of the migrator exist, i.e. whether
+// any migrator was created for this database
+func (m *Migrator) Initialized(ctx context.Context) (bool, error) {
+	for _, table := range []string{m.versionTable, m.historyTableName(), m.repeatableTableName()} {
+		schema := "current_schema()"
+		if i := strings.LastIndexByte(table, '.'); i >= 0 {
+			schema = "'" + table[:i] + "'"
+			table = table[i+1:]
+		}
+
+		var exists bool
+		err := m.conn.QueryRow(ctx, fmt.Sprintf(
+			"select exists(select 1 from information_schema.tables where table_schema = %s and table_name = $1)",
+			schema), table).Scan(&exists)
+		if err != nil {
+			return false, errors.Wrap(err, "Unable to check whether the migration tables exist")
+		}
+		if !exists {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// NewOfflineMigrator creates a migrator without a database connection. It can
+// only load the migrations, e.g. to lint them.
+func NewOfflineMigrator(opts *MigratorOptions) *Migrator {
+	if opts.MigratorFS == nil {
+		opts.MigratorFS = defaultMigratorFS{}
+	}
+	return &Migrator{
+		options:      opts,
+		Migrations:   make([]*Migration, 0),
+		Data:         make(map[string]interface{}),
+		goMigrations: make(map[int64]GoMigration),
+	}
+}
+
+// IsCockroachDB checks whether conn is connected to CockroachDB rather than PostgreSQL
+func IsCockroachDB(ctx context.Context, conn *pgx.Conn) (bool, error) {
+	var version string
+	err := conn.QueryRow(ctx, "select version()").Scan(&version)
+	return strings.Contains(version, "CockroachDB"), err
+}
+
 type MigratorFS interface {
 	ReadDir(dirname string) ([]os.FileInfo, error)
 	ReadFile(filename string) ([]byte, error)
@@ -98,7 +281,18 @@ func (defaultMigratorFS) Glob(pattern string) ([]string, error) {
 	return filepath.Glob(pattern)
 }
 
+func FindMigrations(path string) ([]string, error) {
+	return FindMigrationsEx(path, defaultMigratorFS{})
+}
+
 func FindMigrationsEx(path string, fs MigratorFS) ([]string, error) {
+	return findMigrations(path, fs, nil)
+}
+
+// findMigrations returns paths to the migration files ordered by sequence.
+// Sequences in goSequences are taken by Go migrations and are expected to
+// be missing.
+func findMigrations(path string, fs MigratorFS, goSequences map[int32]bool) ([]string, error) {
 	path = strings.TrimRight(path, string(filepath.Separator))
 
 	fileInfos, err := fs.ReadDir(path)
@@ -107,6 +301,7 @@ func FindMigrationsEx(path string, fs MigratorFS) ([]string, error) {
 	}
 
 	paths := make([]string, 0, len(fileInfos))
+	next := int64(1)
 	for _, fi := range fileInfos {
 		if fi.IsDir() {
 			continue
@@ -123,15 +318,24 @@ func FindMigrationsEx(path string, fs MigratorFS) ([]string, error) {
 			return nil, err
 		}
 
-		if n < int64(len(paths)+1) {
+		for goSequences[int32(next)] && next < n {
+			next++
+		}
+
+		if goSequences[int32(n)] {
+			return nil, fmt.Errorf("Migration %d is defined both in SQL and in Go", n)
+		}
+
+		if n < next {
 			return nil, fmt.Errorf("Duplicate migration %d", n)
 		}
 
-		if int64(len(paths)+1) < n {
-			return nil, fmt.Errorf("Missing migration %d", len(paths)+1)
+		if next < n {
+			return nil, fmt.Errorf("Missing migration %d", next)
 		}
 
 		paths = append(paths, filepath.Join(path, fi.Name()))
+		next++
 	}
 
 	return paths, nil
@@ -140,7 +344,9 @@ func FindMigrationsEx(path string, fs MigratorFS) ([]string, error) {
 func (m *Migrator) LoadMigrations(path string) error {
 	path = strings.TrimRight(path, string(filepath.Separator))
 
-	mainTmpl := template.New("main")
+	// A key missing in Data is most likely a mistake, e.g. a typo or
+	// a setting which is not configured in this environment
+	mainTmpl := template.New("main").Option("missingkey=error")
 	sharedPaths, err := m.options.MigratorFS.Glob(filepath.Join(path, "*", "*.sql"))
 	if err != nil {
 		return err
@@ -159,55 +365,117 @@ func (m *Migrator) LoadMigrations(path string) error {
 		}
 	}
 
-	paths, err := FindMigrationsEx(path, m.options.MigratorFS)
+	if m.timestampVersioning() {
+		err = m.loadTimestampMigrations(mainTmpl, path)
+	} else {
+		err = m.loadSequentialMigrations(mainTmpl, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	return m.loadRepeatableMigrations(mainTmpl, path)
+}
+
+func (m *Migrator) loadSequentialMigrations(mainTmpl *template.Template, path string) error {
+	paths, err := findMigrations(path, m.options.MigratorFS, m.goSequences())
 	if err != nil {
 		return err
 	}
 
-	if len(paths) == 0 {
+	if len(paths) == 0 && len(m.goMigrations) == 0 {
 		return NoMigrationsFoundError{Path: path}
 	}
 
-	for _, p := range paths {
-		body, err := m.options.MigratorFS.ReadFile(p)
+	// Go migrations fill the gaps between the files
+	total := int32(len(paths) + len(m.goMigrations))
+	for seq := int32(1); seq <= total; seq++ {
+		if g, ok := m.goMigrations[int64(seq)]; ok {
+			m.appendGoMigration(g)
+			continue
+		}
+
+		if len(paths) == 0 {
+			return fmt.Errorf("Missing migration %d", seq)
+		}
+
+		err = m.loadMigration(mainTmpl, paths[0])
 		if err != nil {
 			return err
 		}
+		paths = paths[1:]
+	}
 
-		pieces := strings.SplitN(string(body), "---- create above / drop below ----", 2)
-		var upSQL, downSQL string
-		upSQL = strings.TrimSpace(pieces[0])
-		upSQL, err = m.evalMigration(mainTmpl.New(filepath.Base(p)+" up"), upSQL)
+	return nil
+}
+
+func (m *Migrator) loadMigration(mainTmpl *template.Template, p string) error {
+	body, err := m.options.MigratorFS.ReadFile(p)
+	if err != nil {
+		return err
+	}
+
+	txMode, err := parseTxMode(filepath.Base(p), string(body))
+	if err != nil {
+		return err
+	}
+
+	pieces := strings.SplitN(string(body), Separator, 2)
+	var upSQL, downSQL string
+	upSQL = strings.TrimSpace(pieces[0])
+	upSQL, err = m.evalMigration(mainTmpl.New(filepath.Base(p)+" up"), upSQL)
+	if err != nil {
+		return err
+	}
+	// Make sure there is SQL in the forward migration step.
+	// Only account for regular single line comment, empty line and space/comment combination
+	if !containsSQL(upSQL) {
+		return ErrNoFwMigration
+	}
+
+	if len(pieces) == 2 {
+		downSQL = strings.TrimSpace(pieces[1])
+		downSQL, err = m.evalMigration(mainTmpl.New(filepath.Base(p)+" down"), downSQL)
 		if err != nil {
 			return err
 		}
-		// Make sure there is SQL in the forward migration step.
-		containsSQL := false
-		for _, v := range strings.Split(upSQL, "\n") {
-			// Only account for regular single line comment, empty line and space/comment combination
-			cleanString := strings.TrimSpace(v)
-			if len(cleanString) != 0 &&
-				!strings.HasPrefix(cleanString, "--") {
-				containsSQL = true
-				break
-			}
+	}
+
+	m.AppendMigration(filepath.Base(p), upSQL, downSQL)
+	m.Migrations[len(m.Migrations)-1].TxMode = txMode
+
+	return nil
+}
+
+// parseTxMode looks for the transaction mode directive among the comments
+// at the beginning of the migration
+func parseTxMode(name, body string) (TxMode, error) {
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
 		}
-		if !containsSQL {
-			return ErrNoFwMigration
+		if !strings.HasPrefix(line, "--") {
+			break
 		}
 
-		if len(pieces) == 2 {
-			downSQL = strings.TrimSpace(pieces[1])
-			downSQL, err = m.evalMigration(mainTmpl.New(filepath.Base(p)+" down"), downSQL)
-			if err != nil {
-				return err
-			}
+		matches := txModeDirective.FindStringSubmatch(line)
+		if matches == nil {
+			continue
 		}
 
-		m.AppendMigration(filepath.Base(p), upSQL, downSQL)
+		switch matches[1] {
+		case "single":
+			return TxSingle, nil
+		case "own":
+			return TxOwn, nil
+		case "none":
+			return TxNone, nil
+		default:
+			return TxSingle, BadTxModeError{Name: name, Mode: matches[1]}
+		}
 	}
-
-	return nil
+	return TxSingle, nil
 }
 
 func (m *Migrator) evalMigration(tmpl *template.Template, sql string) (string, error) {
@@ -226,125 +494,356 @@ func (m *Migrator) evalMigration(tmpl *template.Template, sql string) (string, e
 }
 
 func (m *Migrator) AppendMigration(name, upSQL, downSQL string) {
+	sequence := int32(len(m.Migrations)) + 1
 	m.Migrations = append(
 		m.Migrations,
 		&Migration{
-			Sequence: int32(len(m.Migrations)) + 1,
+			Sequence: sequence,
+			Version:  int64(sequence),
 			Name:     name,
 			UpSQL:    upSQL,
 			DownSQL:  downSQL,
+			Checksum: checksum(upSQL),
 		})
 	return
 }
 
 // Migrate runs pending migrations
-// It calls m.OnStart when it begins a migration
-func (m *Migrator) Migrate(onCommitFailed func(err error) (retry bool)) error {
-	return m.MigrateTo(int32(len(m.Migrations)), onCommitFailed)
+// It calls m.OnStart when it begins a migration. SchemaTooNewError is
+// returned if the schema is newer than the known migrations, e.g. it was
+// migrated by another replica running a newer version.
+func (m *Migrator) Migrate(ctx context.Context, onCommitFailed func(err error) (retry bool)) error {
+	return m.migrateToLocked(ctx, int32(len(m.Migrations)), false, onCommitFailed)
 }
 
-// MigrateTo migrates to targetVersion
-func (m *Migrator) MigrateTo(targetVersion int32, onCommitFailed func(err error) (retry bool)) (err error) {
-	for { // transaction retry loop
-		// All migrations are executed in a single serializable transaction
-		txOpts := pgx.TxOptions{
-			IsoLevel:       pgx.Serializable,
-			AccessMode:     pgx.ReadWrite,
-		}
-		tx, err := m.conn.BeginTx(context.Background(), txOpts)
-		if err != nil {
-			return errors.Wrap(err, "Unable to begin serializable transaction")
-		}
-		// Rollback has no effect if Commit will be called
-		defer tx.Rollback(context.Background())
+// MigrateTo migrates to targetVersion. Replicas starting at the same time
+// wait for each other, only one of them migrates at a time. Repeatable
+// migrations are applied only when migrating to the latest version.
+func (m *Migrator) MigrateTo(ctx context.Context, targetVersion int32, onCommitFailed func(err error) (retry bool)) error {
+	return m.migrateToLocked(ctx, targetVersion, true, onCommitFailed)
+}
 
-		currentVersion, err := m.GetCurrentVersion()
+func (m *Migrator) migrateToLocked(ctx context.Context, targetVersion int32, allowDown bool,
+	onCommitFailed func(err error) (retry bool)) (err error) {
+	ctx, err = m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = m.unlockWith(err)
+	}()
+
+	// Checked under the lock, another replica could have migrated meanwhile
+	if !allowDown {
+		currentVersion, err := m.GetCurrentVersion(ctx)
 		if err != nil {
 			return errors.Wrap(err, "Unable to get current schema version")
 		}
-
-		if targetVersion < 0 || int32(len(m.Migrations)) < targetVersion {
-			errMsg := fmt.Sprintf("destination version %d is outside the valid versions of 0 to %d", targetVersion, len(m.Migrations))
-			return BadVersionError(errMsg)
+		if currentVersion > targetVersion {
+			return SchemaTooNewError{Version: currentVersion, Latest: targetVersion}
 		}
+	}
+
+	err = m.migrateTo(ctx, targetVersion, onCommitFailed)
+	if err != nil || targetVersion != int32(len(m.Migrations)) {
+		return err
+	}
+
+	return m.applyRepeatables(ctx, onCommitFailed)
+}
+
+// step is a single migration applied in a single direction
+type step struct {
+	migration *Migration
+	direction string
+	sql       string
+	// fn is set instead of sql for Go migrations
+	fn GoMigrationFunc
+	// version after the step
+	version int32
+}
+
+// plan returns the steps required to get from currentVersion to targetVersion
+func (m *Migrator) plan(currentVersion, targetVersion int32) ([]step, error) {
+	if targetVersion < 0 || int32(len(m.Migrations)) < targetVersion {
+		errMsg := fmt.Sprintf("destination version %d is outside the valid versions of 0 to %d", targetVersion, len(m.Migrations))
+		return nil, BadVersionError(errMsg)
+	}
 
-		if currentVersion < 0 || int32(len(m.Migrations)) < currentVersion {
-			errMsg := fmt.Sprintf("current version %d is outside the valid versions of 0 to %d", currentVersion, len(m.Migrations))
-			return BadVersionError(errMsg)
+	if currentVersion < 0 || int32(len(m.Migrations)) < currentVersion {
+		errMsg := fmt.Sprintf("current version %d is outside the valid versions of 0 to %d", currentVersion, len(m.Migrations))
+		return nil, BadVersionError(errMsg)
+	}
+
+	var steps []step
+	for v := currentVersion; v < targetVersion; v++ {
+		current := m.Migrations[v]
+		steps = append(steps, step{migration: current, direction: "up", sql: current.UpSQL, fn: current.Up,
+			version: current.Sequence})
+	}
+
+	for v := currentVersion; v > targetVersion; v-- {
+		current := m.Migrations[v-1]
+		// Check all the steps before running any of them, since
+		// they are not necessarily executed in one transaction
+		if !containsSQL(current.DownSQL) && current.Down == nil {
+			return nil, IrreversibleMigrationError{m: current}
 		}
+		steps = append(steps, step{migration: current, direction: "down", sql: current.DownSQL, fn: current.Down,
+			version: current.Sequence - 1})
+	}
+
+	return steps, nil
+}
+
+// prepare checks the history and returns the steps required to get from
+// currentVersion to targetVersion. Out of order migrations go first, after
+// them the applied migrations are the first ones again.
+func (m *Migrator) prepare(ctx context.Context, currentVersion, targetVersion int32) ([]step, error) {
+	outOfOrder, err := m.checkHistory(ctx, currentVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []step
+	for _, mig := range outOfOrder {
+		currentVersion++
+		steps = append(steps, step{migration: mig, direction: "up", sql: mig.UpSQL, fn: mig.Up,
+			version: currentVersion})
+	}
+
+	if targetVersion < currentVersion && len(outOfOrder) > 0 {
+		errMsg := fmt.Sprintf("destination version %d is below the out of order migrations, migrate up first", targetVersion)
+		return nil, BadVersionError(errMsg)
+	}
+
+	planned, err := m.plan(currentVersion, targetVersion)
+	if err != nil {
+		return nil, err
+	}
+	return append(steps, planned...), nil
+}
+
+// nextBatch returns the number of steps which should be executed together:
+// adjacent TxSingle migrations share a transaction, all other ones are
+// executed separately.
+func nextBatch(steps []step) int {
+	if steps[0].migration.TxMode != TxSingle {
+		return 1
+	}
+
+	n := 1
+	for n < len(steps) && steps[n].migration.TxMode == TxSingle {
+		n++
+	}
+	return n
+}
+
+func (m *Migrator) migrateTo(ctx context.Context, targetVersion int32, onCommitFailed func(err error) (retry bool)) error {
+	currentVersion, dirty, err := m.GetState(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Unable to get current schema version")
+	}
+
+	if dirty {
+		return DirtyError{Version: currentVersion, versionTable: m.versionTable}
+	}
+
+	steps, err := m.prepare(ctx, currentVersion, targetVersion)
+	if err != nil {
+		return err
+	}
 
-		var direction int32
-		if currentVersion < targetVersion {
-			direction = 1
+	err = m.backfillHistory(ctx, currentVersion)
+	if err != nil {
+		return err
+	}
+
+	err = m.verifyChecksums(ctx)
+	if err != nil {
+		return err
+	}
+
+	for len(steps) > 0 {
+		n := nextBatch(steps)
+		if steps[0].migration.TxMode == TxNone {
+			err = m.runWithoutTx(ctx, steps[0])
 		} else {
-			direction = -1
-		}
-
-		for currentVersion != targetVersion {
-			var current *Migration
-			var sql, directionName string
-			var sequence int32
-			if direction == 1 {
-				current = m.Migrations[currentVersion]
-				sequence = current.Sequence
-				sql = current.UpSQL
-				directionName = "up"
-			} else {
-				current = m.Migrations[currentVersion-1]
-				sequence = current.Sequence - 1
-				sql = current.DownSQL
-				directionName = "down"
-				if current.DownSQL == "" {
-					return IrreversibleMigrationError{m: current}
-				}
-			}
-
-			// Fire on start callback
-			if m.OnStart != nil {
-				m.OnStart(current.Sequence, current.Name, directionName, sql)
-			}
-
-			// Execute the migration
-			_, err = m.conn.Exec(context.Background(), sql)
-			if err != nil {
-				return errors.Wrap(err, "Unable to execute migration query")
-			}
-
-			// Add one to the version
-			_, err = m.conn.Exec(context.Background(), "update "+m.versionTable+" set version=$1", sequence)
-			if err != nil {
-				return errors.Wrap(err, "Unable to update schema version")
-			}
-
-			currentVersion = currentVersion + direction
-		}
-
-		err = tx.Commit(context.Background())
+			err = m.runInTx(ctx, steps[:n], currentVersion, onCommitFailed)
+		}
+		if err != nil {
+			return err
+		}
+
+		currentVersion = steps[n-1].version
+		steps = steps[n:]
+	}
+
+	return nil
+}
+
+// runInTx executes steps in a single serializable transaction, retrying it
+// if the commit fails and onCommitFailed allows to
+func (m *Migrator) runInTx(ctx context.Context, steps []step, expectedVersion int32, onCommitFailed func(err error) (retry bool)) error {
+	return retryCommit(onCommitFailed, func() error {
+		return m.runInTxOnce(ctx, steps, expectedVersion)
+	})
+}
+
+// retryCommit calls fn executing a transaction until it succeeds, fails not
+// on commit or onCommitFailed doesn't allow to retry
+func retryCommit(onCommitFailed func(err error) (retry bool), fn func() error) error {
+	for { // transaction retry loop
+		err := fn()
 		if err == nil {
-			break // success
+			return nil // success
+		}
+
+		if _, isCommitErr := err.(commitError); !isCommitErr {
+			return err
 		}
 
-		retry := onCommitFailed(err)
+		retry := onCommitFailed(err.(commitError).err)
 		if !retry {
 			return errors.Wrap(err, "Commit failed, retry = false")
 		}
 	}
+}
+
+type commitError struct {
+	err error
+}
+
+func (e commitError) Error() string {
+	return e.err.Error()
+}
+
+func (m *Migrator) runInTxOnce(ctx context.Context, steps []step, expectedVersion int32) error {
+	txOpts := pgx.TxOptions{
+		IsoLevel:   pgx.Serializable,
+		AccessMode: pgx.ReadWrite,
+	}
+	tx, err := m.conn.BeginTx(ctx, txOpts)
+	if err != nil {
+		return errors.Wrap(err, "Unable to begin serializable transaction")
+	}
+	// Rollback has no effect if Commit will be called
+	defer tx.Rollback(ctx)
+
+	currentVersion, err := m.GetCurrentVersion(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Unable to get current schema version")
+	}
+
+	// Shouldn't happen as long as the migration lock is held
+	if currentVersion != expectedVersion {
+		errMsg := fmt.Sprintf("schema version was changed concurrently from %d to %d", expectedVersion, currentVersion)
+		return BadVersionError(errMsg)
+	}
+
+	for _, s := range steps {
+		// Fire on start callback
+		if m.OnStart != nil {
+			m.OnStart(s.migration.Sequence, s.migration.Name, s.direction, s.sql)
+		}
+
+		// Execute the migration
+		started := time.Now()
+		if s.fn != nil {
+			err = s.fn(ctx, tx)
+		} else {
+			_, err = m.conn.Exec(ctx, s.sql)
+		}
+		if err != nil {
+			return errors.Wrap(err, "Unable to execute migration query")
+		}
+
+		err = m.recordStep(ctx, s, time.Since(started))
+		if err != nil {
+			return err
+		}
+
+		_, err = m.conn.Exec(ctx, "update "+m.versionTable+" set version=$1", s.version)
+		if err != nil {
+			return errors.Wrap(err, "Unable to update schema version")
+		}
+	}
 
+	err = tx.Commit(ctx)
+	if err != nil {
+		return commitError{err: err}
+	}
+	return nil
+}
+
+// runWithoutTx executes statements of a TxNone migration one by one. The
+// schema is marked as dirty until all of them succeed, so that a partially
+// applied migration is not mistaken for an applied or a pending one.
+func (m *Migrator) runWithoutTx(ctx context.Context, s step) error {
+	if m.OnStart != nil {
+		m.OnStart(s.migration.Sequence, s.migration.Name, s.direction, s.sql)
+	}
+
+	_, err := m.conn.Exec(ctx, "update "+m.versionTable+" set dirty=true")
+	if err != nil {
+		return errors.Wrap(err, "Unable to mark schema as dirty")
+	}
+
+	started := time.Now()
+	for _, stmt := range splitStatements(s.sql) {
+		_, err = m.conn.Exec(ctx, stmt)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to execute migration query, %s is left dirty", m.versionTable)
+		}
+	}
+
+	err = m.recordStep(ctx, s, time.Since(started))
+	if err != nil {
+		return err
+	}
+
+	_, err = m.conn.Exec(ctx, "update "+m.versionTable+" set version=$1, dirty=false", s.version)
+	if err != nil {
+		return errors.Wrap(err, "Unable to update schema version")
+	}
 	return nil
 }
 
-func (m *Migrator) GetCurrentVersion() (v int32, err error) {
-	err = m.conn.QueryRow(context.Background(), "select version from " + m.versionTable).Scan(&v)
+func (m *Migrator) GetCurrentVersion(ctx context.Context) (v int32, err error) {
+	return GetVersion(ctx, m.conn, m.versionTable)
+}
+
+// GetState returns the current version and whether a TxNone migration
+// was interrupted leaving the schema in an unknown state
+func (m *Migrator) GetState(ctx context.Context) (v int32, dirty bool, err error) {
+	err = m.conn.QueryRow(ctx, "select version, dirty from "+m.versionTable).Scan(&v, &dirty)
+	return v, dirty, err
+}
+
+// GetVersion reads the current schema version. Unlike NewMigrator it doesn't
+// create the version table, so it's safe to call e.g. from health checks.
+func GetVersion(ctx context.Context, conn *pgx.Conn, versionTable string) (v int32, err error) {
+	err = conn.QueryRow(ctx, "select version from "+versionTable).Scan(&v)
 	return v, err
 }
 
-func (m *Migrator) ensureSchemaVersionTableExists() (err error) {
-	_, err = m.conn.Exec(context.Background(), fmt.Sprintf(`
-    create table if not exists %s(version int4 not null);
+func (m *Migrator) ensureSchemaVersionTableExists(ctx context.Context) (err error) {
+	_, err = m.conn.Exec(ctx, fmt.Sprintf(`
+    create table if not exists %s(version int4 not null, dirty bool not null default false);
 
     insert into %s(version)
     select 0
     where 0=(select count(*) from %s);
   `, m.versionTable, m.versionTable, m.versionTable))
+	if err != nil {
+		return err
+	}
+
+	// The table could be created by a version which didn't have this column.
+	// CockroachDB doesn't allow schema changes in a multi-statement
+	// transaction after writes, so this is a separate statement.
+	_, err = m.conn.Exec(ctx, fmt.Sprintf(`
+    alter table %s add column if not exists dirty bool not null default false
+  `, m.versionTable))
 	return err
 }
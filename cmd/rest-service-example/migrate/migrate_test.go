@@ -0,0 +1,100 @@
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTxMode(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		body string
+		mode TxMode
+	}{
+		{"CREATE TABLE t(id INT);", TxSingle},
+		{"-- migrate:tx=single\nCREATE TABLE t(id INT);", TxSingle},
+		{"-- migrate:tx=own\nCREATE TABLE t(id INT);", TxOwn},
+		{"-- Build the index without locking the table\n\n--migrate:tx=none\nCREATE INDEX CONCURRENTLY i ON t(id);", TxNone},
+		// Directives are recognized only in the header
+		{"CREATE TABLE t(id INT);\n-- migrate:tx=none\n", TxSingle},
+	}
+
+	for _, c := range cases {
+		mode, err := parseTxMode("0001_test.sql", c.body)
+		require.NoError(t, err, c.body)
+		require.Equal(t, c.mode, mode, c.body)
+	}
+
+	_, err := parseTxMode("0001_test.sql", "-- migrate:tx=nope\nSELECT 1;")
+	require.Equal(t, BadTxModeError{Name: "0001_test.sql", Mode: "nope"}, err)
+}
+
+func TestNextBatch(t *testing.T) {
+	t.Parallel()
+
+	steps := func(modes ...TxMode) []step {
+		var result []step
+		for _, mode := range modes {
+			result = append(result, step{migration: &Migration{TxMode: mode}})
+		}
+		return result
+	}
+
+	cases := []struct {
+		steps []step
+		n     int
+	}{
+		{steps(TxSingle), 1},
+		{steps(TxSingle, TxSingle, TxSingle), 3},
+		{steps(TxSingle, TxSingle, TxOwn, TxSingle), 2},
+		{steps(TxSingle, TxNone), 1},
+		{steps(TxOwn, TxSingle), 1},
+		{steps(TxNone, TxSingle), 1},
+	}
+
+	for i, c := range cases {
+		require.Equal(t, c.n, nextBatch(c.steps), i)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	t.Parallel()
+
+	// Checksums are stored in the database, so the format must not change
+	m := &Migrator{}
+	m.AppendMigration("0001_test.sql", "CREATE TABLE t(id INT);", "DROP TABLE t;")
+	require.Equal(t, "0d3da698092ce12216f7063c680c19d408aa1aac06c00a1d1820eb5abaf2bf6e", m.Migrations[0].Checksum)
+}
+
+func TestTemplateData(t *testing.T) {
+	t.Parallel()
+
+	files := fstest.MapFS{
+		"0001_grant.sql": {Data: []byte("GRANT SELECT ON t TO {{.grant_role}};")},
+	}
+
+	m := &Migrator{options: &MigratorOptions{MigratorFS: NewMigratorFS(files)}, Data: map[string]interface{}{
+		"grant_role": "reader",
+	}}
+	err := m.LoadMigrations(".")
+	require.NoError(t, err)
+	require.Equal(t, "GRANT SELECT ON t TO reader;", m.Migrations[0].UpSQL)
+
+	// The checksum is computed over the rendered SQL, so a different value
+	// is a drift of the applied migration
+	other := &Migrator{options: &MigratorOptions{MigratorFS: NewMigratorFS(files)}, Data: map[string]interface{}{
+		"grant_role": "writer",
+	}}
+	err = other.LoadMigrations(".")
+	require.NoError(t, err)
+	require.NotEqual(t, m.Migrations[0].Checksum, other.Migrations[0].Checksum)
+
+	// A missing key is an error rather than "<no value>" in the SQL
+	m = &Migrator{options: &MigratorOptions{MigratorFS: NewMigratorFS(files)}, Data: map[string]interface{}{}}
+	err = m.LoadMigrations(".")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `map has no entry for key "grant_role"`)
+}
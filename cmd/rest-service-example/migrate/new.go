@@ -0,0 +1,38 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const newMigrationTemplate = `-- Write the forward migration here
+
+` + Separator + `
+
+-- Write the rollback here, or remove the separator if the migration is irreversible
+`
+
+// NewMigrationFile returns the file name for a new migration in path and its
+// initial contents. The number is the next sequence after the existing files
+// and Go migrations, or now with TimestampVersioning.
+func NewMigrationFile(path string, fs MigratorFS, versioning Versioning, goMigrations []GoMigration, name string,
+	now time.Time) (filename string, contents []byte, err error) {
+	count, err := CountMigrations(path, fs, versioning, goMigrations)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if versioning == TimestampVersioning {
+		filename = fmt.Sprintf("%s_%s.sql", now.UTC().Format(timestampLayout), name)
+	} else {
+		filename = fmt.Sprintf("%04d_%s.sql", count+1, name)
+	}
+
+	// Otherwise the file would be ignored by LoadMigrations
+	if !migrationPattern.MatchString(filename) || strings.ContainsAny(name, `/\`) {
+		return "", nil, fmt.Errorf("Invalid migration name %q", name)
+	}
+
+	return filename, []byte(newMigrationTemplate), nil
+}
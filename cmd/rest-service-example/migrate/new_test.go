@@ -0,0 +1,67 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMigrationFile(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 2, 6, 12, 30, 0, 0, time.UTC)
+	sequential := NewMigratorFS(fstest.MapFS{
+		"0001_create_t.sql": {Data: []byte("CREATE TABLE t(id INT);")},
+		"0002_alter_t.sql":  {Data: []byte("ALTER TABLE t ADD COLUMN name TEXT;")},
+	})
+	timestamp := NewMigratorFS(fstest.MapFS{
+		"20200101000000_create_t.sql": {Data: []byte("CREATE TABLE t(id INT);")},
+	})
+
+	cases := []struct {
+		fs           MigratorFS
+		versioning   Versioning
+		goMigrations []GoMigration
+		name         string
+		filename     string
+		err          string
+	}{
+		{sequential, SequentialVersioning, nil, "add_index", "0003_add_index.sql", ""},
+		{sequential, SequentialVersioning, []GoMigration{{Sequence: 3}}, "add_index", "0004_add_index.sql", ""},
+		{NewMigratorFS(fstest.MapFS{}), SequentialVersioning, nil, "create_t", "0001_create_t.sql", ""},
+		{timestamp, TimestampVersioning, nil, "add_index", "20200206123000_add_index.sql", ""},
+		{sequential, SequentialVersioning, nil, "", "", `Invalid migration name ""`},
+		{sequential, SequentialVersioning, nil, "a\nb", "", `Invalid migration name "a\nb"`},
+		{sequential, SequentialVersioning, nil, "shared/a", "", `Invalid migration name "shared/a"`},
+	}
+
+	for _, c := range cases {
+		filename, contents, err := NewMigrationFile(".", c.fs, c.versioning, c.goMigrations, c.name, now)
+		if c.err != "" {
+			require.EqualError(t, err, c.err, c.name)
+			continue
+		}
+
+		require.NoError(t, err, c.name)
+		require.Equal(t, c.filename, filename)
+		require.Contains(t, string(contents), Separator)
+	}
+}
+
+func TestNewMigrationTemplate(t *testing.T) {
+	t.Parallel()
+
+	// An unedited scaffold has no rollback
+	m := &Migrator{}
+	m.AppendMigration("0001_scaffold.sql", "CREATE TABLE t(id INT);", strings.TrimSpace(
+		strings.SplitN(newMigrationTemplate, Separator, 2)[1]))
+	findings := Lint(m.Migrations, false)
+	require.Len(t, findings, 1)
+	require.Equal(t, LintMissingDown, findings[0].Rule)
+
+	_, err := m.plan(1, 0)
+	require.Equal(t, IrreversibleMigrationError{m: m.Migrations[0]}, err)
+}
@@ -0,0 +1,172 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+)
+
+var repeatablePattern = regexp.MustCompile(`\AR__.+\.sql\z`)
+
+// RepeatableMigration is a migration re-applied whenever its rendered SQL
+// changes, e.g. CREATE OR REPLACE VIEW or GRANT statements. Repeatable
+// migrations are named R__name.sql and applied in the order of names after
+// all the versioned ones. Removing a file doesn't undo the migration.
+type RepeatableMigration struct {
+	Name string
+	SQL  string
+	// Checksum is a SHA-256 of SQL, a migration is applied again when it
+	// differs from the recorded one
+	Checksum string
+}
+
+func (m *Migrator) repeatableTableName() string {
+	return m.versionTable + "_repeatable"
+}
+
+// ensureRepeatableTableExists creates a table with the checksums of the
+// applied repeatable migrations
+func (m *Migrator) ensureRepeatableTableExists(ctx context.Context) error {
+	_, err := m.conn.Exec(ctx, fmt.Sprintf(`
+    create table if not exists %s(
+      name text primary key,
+      checksum text not null,
+      applied_at timestamptz not null,
+      duration interval not null,
+      host text not null
+    )
+  `, m.repeatableTableName()))
+	return err
+}
+
+func (m *Migrator) loadRepeatableMigrations(mainTmpl *template.Template, path string) error {
+	fileInfos, err := m.options.MigratorFS.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range fileInfos {
+		if fi.IsDir() || !repeatablePattern.MatchString(fi.Name()) {
+			continue
+		}
+
+		body, err := m.options.MigratorFS.ReadFile(filepath.Join(path, fi.Name()))
+		if err != nil {
+			return err
+		}
+
+		if strings.Contains(string(body), Separator) {
+			return fmt.Errorf("Repeatable migration %s can't have a down part", fi.Name())
+		}
+
+		sql, err := m.evalMigration(mainTmpl.New(fi.Name()), strings.TrimSpace(string(body)))
+		if err != nil {
+			return err
+		}
+
+		if !containsSQL(sql) {
+			return ErrNoFwMigration
+		}
+
+		m.Repeatables = append(m.Repeatables, &RepeatableMigration{
+			Name:     fi.Name(),
+			SQL:      sql,
+			Checksum: checksum(sql),
+		})
+	}
+
+	return nil
+}
+
+// PendingRepeatables returns the repeatable migrations which were never
+// applied or were changed since then
+func (m *Migrator) PendingRepeatables(ctx context.Context) ([]*RepeatableMigration, error) {
+	rows, err := m.conn.Query(ctx, fmt.Sprintf("select name, checksum from %s", m.repeatableTableName()))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read repeatable migrations")
+	}
+	defer rows.Close()
+
+	applied := make(map[string]string)
+	for rows.Next() {
+		var name, recorded string
+		err = rows.Scan(&name, &recorded)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to read repeatable migrations")
+		}
+		applied[name] = recorded
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Unable to read repeatable migrations")
+	}
+
+	var pending []*RepeatableMigration
+	for _, r := range m.Repeatables {
+		if applied[r.Name] != r.Checksum {
+			pending = append(pending, r)
+		}
+	}
+	return pending, nil
+}
+
+// applyRepeatables applies the pending repeatable migrations, each one in
+// a separate transaction
+func (m *Migrator) applyRepeatables(ctx context.Context, onCommitFailed func(err error) (retry bool)) error {
+	pending, err := m.PendingRepeatables(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range pending {
+		r := r
+		err = retryCommit(onCommitFailed, func() error {
+			return m.applyRepeatableOnce(ctx, r)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) applyRepeatableOnce(ctx context.Context, r *RepeatableMigration) error {
+	tx, err := m.conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+	if err != nil {
+		return errors.Wrap(err, "Unable to begin serializable transaction")
+	}
+	// Rollback has no effect if Commit will be called
+	defer tx.Rollback(ctx)
+
+	if m.OnStart != nil {
+		m.OnStart(0, r.Name, "repeatable", r.SQL)
+	}
+
+	started := time.Now()
+	_, err = m.conn.Exec(ctx, r.SQL)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to execute repeatable migration %s", r.Name)
+	}
+
+	_, err = m.conn.Exec(ctx, fmt.Sprintf(`
+    insert into %s(name, checksum, applied_at, duration, host) values ($1, $2, now(), $3, $4)
+    on conflict (name) do update set checksum = excluded.checksum, applied_at = excluded.applied_at,
+      duration = excluded.duration, host = excluded.host
+  `, m.repeatableTableName()), r.Name, r.Checksum, time.Since(started), m.host)
+	if err != nil {
+		return errors.Wrap(err, "Unable to record repeatable migration")
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return commitError{err: err}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadRepeatableMigrations(t *testing.T) {
+	t.Parallel()
+
+	files := fstest.MapFS{
+		"0001_create_t.sql":  {Data: []byte("CREATE TABLE t(id INT, name TEXT);")},
+		"shared/columns.sql": {Data: []byte("id, name")},
+		"R__t_view.sql":      {Data: []byte(`CREATE OR REPLACE VIEW t_view AS SELECT {{template "shared/columns.sql"}} FROM t;`)},
+		"R__grants.sql": {Data: []byte("{{if .CockroachDB}}GRANT SELECT ON t TO reader;{{else}}" +
+			"GRANT SELECT ON ALL TABLES IN SCHEMA public TO reader;{{end}}")},
+	}
+
+	m := &Migrator{options: &MigratorOptions{MigratorFS: NewMigratorFS(files)}, Data: map[string]interface{}{
+		"CockroachDB": false,
+	}}
+	err := m.LoadMigrations(".")
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 1)
+	require.Len(t, m.Repeatables, 2)
+
+	// In the order of names
+	require.Equal(t, "R__grants.sql", m.Repeatables[0].Name)
+	require.Equal(t, "GRANT SELECT ON ALL TABLES IN SCHEMA public TO reader;", m.Repeatables[0].SQL)
+	require.Equal(t, "R__t_view.sql", m.Repeatables[1].Name)
+	require.Equal(t, "CREATE OR REPLACE VIEW t_view AS SELECT id, name FROM t;", m.Repeatables[1].SQL)
+	require.Equal(t, checksum(m.Repeatables[1].SQL), m.Repeatables[1].Checksum)
+
+	// The checksum depends on the rendered SQL
+	m = &Migrator{options: &MigratorOptions{MigratorFS: NewMigratorFS(files)}, Data: map[string]interface{}{
+		"CockroachDB": true,
+	}}
+	err = m.LoadMigrations(".")
+	require.NoError(t, err)
+	require.Equal(t, checksum("GRANT SELECT ON t TO reader;"), m.Repeatables[0].Checksum)
+
+	files["R__down.sql"] = &fstest.MapFile{Data: []byte("SELECT 1;\n" + Separator + "\nSELECT 2;")}
+	m = &Migrator{options: &MigratorOptions{MigratorFS: NewMigratorFS(files)}, Data: map[string]interface{}{}}
+	err = m.LoadMigrations(".")
+	require.EqualError(t, err, "Repeatable migration R__down.sql can't have a down part")
+}
@@ -0,0 +1,157 @@
+package migrate
+
+import (
+	"strings"
+)
+
+// splitStatements splits a migration into separate statements. Semicolons
+// inside quoted strings, quoted identifiers, dollar-quoted strings (used in
+// function bodies) and comments are not treated as separators. Comments
+// are kept as a part of the statement which follows them. Statements which
+// consist only of comments and whitespace are skipped.
+func splitStatements(sql string) []string {
+	var stmts []string
+	start := 0
+	i := 0
+	for i < len(sql) {
+		switch {
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end + 1
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += 2 + end + 2
+			}
+		case sql[i] == '\'' || sql[i] == '"':
+			i = skipQuoted(sql, i, sql[i])
+		case sql[i] == '$':
+			tag, ok := dollarQuoteTag(sql[i:])
+			if !ok {
+				i++
+				continue
+			}
+			end := strings.Index(sql[i+len(tag):], tag)
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += len(tag) + end + len(tag)
+			}
+		case sql[i] == ';':
+			stmts = appendStatement(stmts, sql[start:i])
+			i++
+			start = i
+		default:
+			i++
+		}
+	}
+	return appendStatement(stmts, sql[start:])
+}
+
+// stripComments removes comments from a statement and returns them
+// separately without the comment markers
+func stripComments(stmt string) (sql string, comments []string) {
+	var b strings.Builder
+	i := 0
+	for i < len(stmt) {
+		switch {
+		case strings.HasPrefix(stmt[i:], "--"):
+			end := strings.IndexByte(stmt[i:], '\n')
+			if end < 0 {
+				end = len(stmt) - i
+			}
+			comments = append(comments, strings.TrimSpace(stmt[i+2:i+end]))
+			b.WriteByte(' ')
+			i += end
+		case strings.HasPrefix(stmt[i:], "/*"):
+			end := strings.Index(stmt[i+2:], "*/")
+			if end < 0 {
+				comments = append(comments, strings.TrimSpace(stmt[i+2:]))
+				i = len(stmt)
+			} else {
+				comments = append(comments, strings.TrimSpace(stmt[i+2:i+2+end]))
+				i += 2 + end + 2
+			}
+			b.WriteByte(' ')
+		case stmt[i] == '\'' || stmt[i] == '"':
+			end := skipQuoted(stmt, i, stmt[i])
+			b.WriteString(stmt[i:end])
+			i = end
+		case stmt[i] == '$':
+			end := i + 1
+			if tag, ok := dollarQuoteTag(stmt[i:]); ok {
+				end = len(stmt)
+				if j := strings.Index(stmt[i+len(tag):], tag); j >= 0 {
+					end = i + len(tag) + j + len(tag)
+				}
+			}
+			b.WriteString(stmt[i:end])
+			i = end
+		default:
+			b.WriteByte(stmt[i])
+			i++
+		}
+	}
+	return strings.TrimSpace(b.String()), comments
+}
+
+// skipQuoted returns the position right after the closing quote. A quote
+// inside a string is escaped by doubling it.
+func skipQuoted(sql string, i int, quote byte) int {
+	i++
+	for i < len(sql) {
+		if sql[i] == quote {
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return i
+}
+
+// dollarQuoteTag returns the opening tag of a dollar-quoted string like
+// $$ or $body$. Positional parameters like $1 are not tags.
+func dollarQuoteTag(s string) (string, bool) {
+	for j := 1; j < len(s); j++ {
+		c := s[j]
+		if c == '$' {
+			return s[:j+1], true
+		}
+		isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !(isDigit && j > 1) {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func appendStatement(stmts []string, stmt string) []string {
+	stmt = strings.TrimSpace(stmt)
+	if containsSQL(stmt) {
+		stmts = append(stmts, stmt)
+	}
+	return stmts
+}
+
+// containsSQL reports whether there is anything besides single line
+// comments and whitespace
+func containsSQL(sql string) bool {
+	for _, v := range strings.Split(sql, "\n") {
+		cleanString := strings.TrimSpace(v)
+		if len(cleanString) != 0 &&
+			!strings.HasPrefix(cleanString, "--") {
+			return true
+		}
+	}
+	return false
+}
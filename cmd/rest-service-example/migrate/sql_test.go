@@ -0,0 +1,61 @@
+package migrate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitStatements(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		sql   string
+		stmts []string
+	}{
+		{"", nil},
+		{"-- just a comment\n", nil},
+		{"SELECT 1", []string{"SELECT 1"}},
+		{"SELECT 1;\nSELECT 2;\n", []string{"SELECT 1", "SELECT 2"}},
+		{"SELECT ';';", []string{"SELECT ';'"}},
+		{"SELECT 'it''s; fine'; SELECT 2", []string{"SELECT 'it''s; fine'", "SELECT 2"}},
+		{`CREATE TABLE "a;b"(id int);`, []string{`CREATE TABLE "a;b"(id int)`}},
+		{"-- comment; with semicolon\nSELECT 1;", []string{"-- comment; with semicolon\nSELECT 1"}},
+		{"/* a; b */ SELECT 1; SELECT 2 -- trailing;\n", []string{"/* a; b */ SELECT 1", "SELECT 2 -- trailing;"}},
+		{
+			"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql;\nSELECT f();",
+			[]string{"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql", "SELECT f()"},
+		},
+		{
+			"DO $body$ BEGIN PERFORM 1; END $body$; SELECT $1;",
+			[]string{"DO $body$ BEGIN PERFORM 1; END $body$", "SELECT $1"},
+		},
+		{"CREATE INDEX CONCURRENTLY i ON t(c);\n-- the end\n", []string{"CREATE INDEX CONCURRENTLY i ON t(c)"}},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.stmts, splitStatements(c.sql), c.sql)
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		stmt     string
+		sql      string
+		comments []string
+	}{
+		{"SELECT 1", "SELECT 1", nil},
+		{"-- a\nSELECT 1 -- b", "SELECT 1", []string{"a", "b"}},
+		{"SELECT /* a */ 1 /* b", "SELECT   1", []string{"a", "b"}},
+		{"SELECT '-- a', \"/* b */\"", "SELECT '-- a', \"/* b */\"", nil},
+		{"DO $$ BEGIN -- a\nEND $$", "DO $$ BEGIN -- a\nEND $$", nil},
+	}
+
+	for _, c := range cases {
+		sql, comments := stripComments(c.stmt)
+		require.Equal(t, c.sql, sql, c.stmt)
+		require.Equal(t, c.comments, comments, c.stmt)
+	}
+}
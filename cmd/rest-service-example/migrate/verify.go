@@ -0,0 +1,209 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// snapshotQueries describe the schema for comparing it before and after
+// a migration. Names of the NOT NULL constraints contain OIDs in PostgreSQL,
+// so they are skipped, nullability is a part of the columns anyway.
+var snapshotQueries = []string{
+	`select 'table', table_schema, table_name, table_type
+    from information_schema.tables
+    where table_schema not in ('pg_catalog', 'information_schema', 'crdb_internal', 'pg_extension')`,
+	`select 'column', table_schema, table_name, column_name, data_type, is_nullable, column_default,
+      character_maximum_length, numeric_precision, numeric_scale
+    from information_schema.columns
+    where table_schema not in ('pg_catalog', 'information_schema', 'crdb_internal', 'pg_extension')`,
+	`select 'constraint', table_schema, table_name, constraint_name, constraint_type
+    from information_schema.table_constraints
+    where table_schema not in ('pg_catalog', 'information_schema', 'crdb_internal', 'pg_extension')
+      and not (constraint_type = 'CHECK' and constraint_name like '%not_null')`,
+	// information_schema doesn't describe indexes
+	`select 'index', schemaname, tablename, indexname, indexdef
+    from pg_catalog.pg_indexes
+    where schemaname not in ('pg_catalog', 'information_schema', 'crdb_internal', 'pg_extension')`,
+}
+
+// SchemaSnapshot is a sorted list of the tables, columns, constraints and
+// indexes of the database, one per line
+type SchemaSnapshot []string
+
+// SchemaMismatchError means that rolling back a migration didn't restore
+// the schema, or applying it again produced a different one
+type SchemaMismatchError struct {
+	Name      string
+	Direction string
+	// Missing are the lines of the expected snapshot not found in the actual one
+	Missing []string
+	// Extra are the lines of the actual snapshot not found in the expected one
+	Extra []string
+}
+
+func (e SchemaMismatchError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Schema after %s of %s differs from the expected one", e.Direction, e.Name)
+	for _, line := range e.Missing {
+		fmt.Fprintf(&b, "\n- %s", line)
+	}
+	for _, line := range e.Extra {
+		fmt.Fprintf(&b, "\n+ %s", line)
+	}
+	return b.String()
+}
+
+// Snapshot returns the current schema of the database
+func (m *Migrator) Snapshot(ctx context.Context) (SchemaSnapshot, error) {
+	var snapshot SchemaSnapshot
+	for _, query := range snapshotQueries {
+		rows, err := m.conn.Query(ctx, query)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to take a schema snapshot")
+		}
+
+		for rows.Next() {
+			values, err := rows.Values()
+			if err != nil {
+				rows.Close()
+				return nil, errors.Wrap(err, "Unable to take a schema snapshot")
+			}
+
+			fields := make([]string, 0, len(values))
+			for _, v := range values {
+				if v == nil {
+					v = "null"
+				}
+				fields = append(fields, fmt.Sprint(v))
+			}
+			snapshot = append(snapshot, strings.Join(fields, " "))
+		}
+
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, errors.Wrap(err, "Unable to take a schema snapshot")
+		}
+	}
+
+	sort.Strings(snapshot)
+	return snapshot, nil
+}
+
+// diff returns the lines of expected missing in actual and the lines of
+// actual missing in expected
+func (expected SchemaSnapshot) diff(actual SchemaSnapshot) (missing, extra []string) {
+	counts := make(map[string]int, len(expected))
+	for _, line := range expected {
+		counts[line]++
+	}
+	for _, line := range actual {
+		counts[line]--
+	}
+
+	for _, line := range expected {
+		if counts[line] > 0 {
+			missing = append(missing, line)
+			counts[line]--
+		}
+	}
+	for _, line := range actual {
+		if counts[line] < 0 {
+			extra = append(extra, line)
+			counts[line]++
+		}
+	}
+	return missing, extra
+}
+
+// Verify checks that every migration can be rolled back. For each migration
+// in sequence it applies the migration, rolls it back, compares the schema
+// with the one before the migration and applies the migration again, the
+// schema should be the same as after the first time. Irreversible migrations
+// are only applied, they are returned as not verified. Repeatable migrations
+// are applied at the end.
+//
+// Data migrations are executed twice, so Verify refuses to run on a database
+// where any migrations were applied. Use a scratch database, e.g. in CI.
+func (m *Migrator) Verify(ctx context.Context, onCommitFailed func(err error) (retry bool)) (notVerified []*Migration, err error) {
+	ctx, err = m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = m.unlockWith(err)
+	}()
+
+	currentVersion, err := m.GetCurrentVersion(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to get current schema version")
+	}
+
+	if currentVersion != 0 {
+		return nil, fmt.Errorf("Verify should be run on an empty database, current schema version is %d",
+			currentVersion)
+	}
+
+	before, err := m.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mig := range m.Migrations {
+		err = m.migrateTo(ctx, mig.Sequence, onCommitFailed)
+		if err != nil {
+			return nil, err
+		}
+
+		after, err := m.Snapshot(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if !containsSQL(mig.DownSQL) && mig.Down == nil {
+			notVerified = append(notVerified, mig)
+			before = after
+			continue
+		}
+
+		err = m.verifyStep(ctx, mig, mig.Sequence-1, "down", before, onCommitFailed)
+		if err != nil {
+			return nil, err
+		}
+
+		err = m.verifyStep(ctx, mig, mig.Sequence, "up", after, onCommitFailed)
+		if err != nil {
+			return nil, err
+		}
+		before = after
+	}
+
+	err = m.applyRepeatables(ctx, onCommitFailed)
+	if err != nil {
+		return nil, err
+	}
+	return notVerified, nil
+}
+
+// verifyStep migrates to targetVersion and compares the schema with expected
+func (m *Migrator) verifyStep(ctx context.Context, mig *Migration, targetVersion int32, direction string,
+	expected SchemaSnapshot, onCommitFailed func(err error) (retry bool)) error {
+	err := m.migrateTo(ctx, targetVersion, onCommitFailed)
+	if err != nil {
+		return err
+	}
+
+	actual, err := m.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	missing, extra := expected.diff(actual)
+	if len(missing) > 0 || len(extra) > 0 {
+		return SchemaMismatchError{Name: mig.Name, Direction: direction, Missing: missing, Extra: extra}
+	}
+	return nil
+}
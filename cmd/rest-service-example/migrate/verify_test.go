@@ -0,0 +1,42 @@
+package migrate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotDiff(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		expected, actual SchemaSnapshot
+		missing, extra   []string
+	}{
+		{nil, nil, nil, nil},
+		{SchemaSnapshot{"a", "b"}, SchemaSnapshot{"a", "b"}, nil, nil},
+		{SchemaSnapshot{"a", "b"}, SchemaSnapshot{"a"}, []string{"b"}, nil},
+		{SchemaSnapshot{"a"}, SchemaSnapshot{"a", "c"}, nil, []string{"c"}},
+		{SchemaSnapshot{"a", "a", "b"}, SchemaSnapshot{"a", "c"}, []string{"a", "b"}, []string{"c"}},
+	}
+
+	for _, c := range cases {
+		missing, extra := c.expected.diff(c.actual)
+		require.Equal(t, c.missing, missing, c.expected)
+		require.Equal(t, c.extra, extra, c.expected)
+	}
+}
+
+func TestSchemaMismatchError(t *testing.T) {
+	t.Parallel()
+
+	err := SchemaMismatchError{
+		Name:      "0002_add_phone.sql",
+		Direction: "down",
+		Missing:   []string{"column public phonebook id bigint NO"},
+		Extra:     []string{"column public phonebook phone text YES"},
+	}
+	require.EqualError(t, err, "Schema after down of 0002_add_phone.sql differs from the expected one\n"+
+		"- column public phonebook id bigint NO\n"+
+		"+ column public phonebook phone text YES")
+}
@@ -0,0 +1,437 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+)
+
+// Versioning defines how the migration files are numbered
+type Versioning int
+
+const (
+	// SequentialVersioning requires files to be named 0001_name.sql,
+	// 0002_name.sql and so on without gaps. This is the default.
+	SequentialVersioning Versioning = iota
+	// TimestampVersioning requires files to be named YYYYMMDDHHMMSS_name.sql.
+	// Migrations added in different branches don't conflict, but can be
+	// merged out of order, i.e. older than an already applied migration.
+	TimestampVersioning
+)
+
+const timestampLayout = "20060102150405"
+
+var timestampPattern = regexp.MustCompile(`\A(\d{14})_.+\.sql\z`)
+
+var versionPrefix = regexp.MustCompile(`\A\d+_`)
+
+// ParseVersioning parses the name of the versioning scheme
+func ParseVersioning(s string) (Versioning, error) {
+	switch s {
+	case "sequential":
+		return SequentialVersioning, nil
+	case "timestamp":
+		return TimestampVersioning, nil
+	default:
+		return SequentialVersioning, fmt.Errorf("Unknown versioning %q, expected one of: sequential, timestamp", s)
+	}
+}
+
+func (v Versioning) String() string {
+	if v == TimestampVersioning {
+		return "timestamp"
+	}
+	return "sequential"
+}
+
+func isTimestamp(version int64) bool {
+	_, err := time.Parse(timestampLayout, strconv.FormatInt(version, 10))
+	return err == nil
+}
+
+// OutOfOrderError means that there are pending migrations older than the last
+// applied one, usually because they were merged from a different branch.
+// They can be applied with MigratorOptions.AllowOutOfOrder.
+type OutOfOrderError struct {
+	Migrations  []*Migration
+	LastApplied int64
+}
+
+func (e OutOfOrderError) Error() string {
+	names := make([]string, 0, len(e.Migrations))
+	for _, m := range e.Migrations {
+		names = append(names, m.Name)
+	}
+	return fmt.Sprintf("Pending migrations are older than the last applied migration %d: %s",
+		e.LastApplied, strings.Join(names, ", "))
+}
+
+// UnknownMigrationError means that an applied migration is not among
+// the loaded ones, e.g. the binary is older than the schema
+type UnknownMigrationError struct {
+	Version int64
+	Name    string
+}
+
+func (e UnknownMigrationError) Error() string {
+	return fmt.Sprintf("Applied migration %d - %s is unknown", e.Version, e.Name)
+}
+
+// VersioningMismatchError means that the history was recorded with a different
+// versioning scheme. A database migrated with sequential versions can be
+// converted with ConvertToTimestamps.
+type VersioningMismatchError struct {
+	Versioning Versioning
+	Version    int64
+	Name       string
+}
+
+func (e VersioningMismatchError) Error() string {
+	return fmt.Sprintf("Applied migration %d - %s doesn't match %s versioning, the versions should be converted first",
+		e.Version, e.Name, e.Versioning)
+}
+
+func (m *Migrator) versioning() Versioning {
+	if m.options == nil {
+		return SequentialVersioning
+	}
+	return m.options.Versioning
+}
+
+func (m *Migrator) timestampVersioning() bool {
+	return m.versioning() == TimestampVersioning
+}
+
+type timestampFile struct {
+	version int64
+	path    string
+}
+
+// findTimestampMigrations returns the migration files ordered by version.
+// Versions in goVersions are taken by Go migrations.
+func findTimestampMigrations(path string, fs MigratorFS, goVersions map[int64]bool) ([]timestampFile, error) {
+	path = strings.TrimRight(path, string(filepath.Separator))
+
+	fileInfos, err := fs.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []timestampFile
+	for _, fi := range fileInfos {
+		if fi.IsDir() {
+			continue
+		}
+
+		matches := timestampPattern.FindStringSubmatch(fi.Name())
+		if len(matches) != 2 {
+			// Most likely a mistake, the file would be silently ignored otherwise
+			if migrationPattern.MatchString(fi.Name()) {
+				return nil, fmt.Errorf("Migration %s should be named YYYYMMDDHHMMSS_name.sql", fi.Name())
+			}
+			continue
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil || !isTimestamp(version) {
+			return nil, fmt.Errorf("Invalid timestamp in migration %s", fi.Name())
+		}
+
+		if goVersions[version] {
+			return nil, fmt.Errorf("Migration %d is defined both in SQL and in Go", version)
+		}
+
+		// ReadDir returns files sorted by name, i.e. by version
+		if len(files) > 0 && files[len(files)-1].version == version {
+			return nil, fmt.Errorf("Duplicate migration %d", version)
+		}
+
+		files = append(files, timestampFile{version: version, path: filepath.Join(path, fi.Name())})
+	}
+
+	return files, nil
+}
+
+func (m *Migrator) loadTimestampMigrations(mainTmpl *template.Template, path string) error {
+	goVersions := make(map[int64]bool, len(m.goMigrations))
+	for version := range m.goMigrations {
+		goVersions[version] = true
+	}
+
+	files, err := findTimestampMigrations(path, m.options.MigratorFS, goVersions)
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 && len(m.goMigrations) == 0 {
+		return NoMigrationsFoundError{Path: path}
+	}
+
+	for version := range goVersions {
+		files = append(files, timestampFile{version: version})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].version < files[j].version
+	})
+
+	for _, f := range files {
+		if f.path == "" {
+			m.appendGoMigration(m.goMigrations[f.version])
+			continue
+		}
+
+		err = m.loadMigration(mainTmpl, f.path)
+		if err != nil {
+			return err
+		}
+		m.Migrations[len(m.Migrations)-1].Version = f.version
+	}
+
+	return nil
+}
+
+func (m *Migrator) migrationsByVersion() map[int64]*Migration {
+	byVersion := make(map[int64]*Migration, len(m.Migrations))
+	for _, mig := range m.Migrations {
+		byVersion[mig.Version] = mig
+	}
+	return byVersion
+}
+
+// historyVersions returns the names of the migrations in the history by
+// version
+func (m *Migrator) historyVersions(ctx context.Context) (map[int64]string, error) {
+	rows, err := m.conn.Query(ctx, fmt.Sprintf("select version, name from %s", m.historyTableName()))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read migration history")
+	}
+	defer rows.Close()
+
+	versions := make(map[int64]string)
+	for rows.Next() {
+		var version int64
+		var name string
+		err = rows.Scan(&version, &name)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to read migration history")
+		}
+		versions[version] = name
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Unable to read migration history")
+	}
+	return versions, nil
+}
+
+// Applied returns the versions of the applied migrations
+func (m *Migrator) Applied(ctx context.Context) (map[int64]bool, error) {
+	applied := make(map[int64]bool)
+	if m.timestampVersioning() {
+		history, err := m.historyVersions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for version := range history {
+			applied[version] = true
+		}
+		return applied, nil
+	}
+
+	current, err := m.GetCurrentVersion(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to get current schema version")
+	}
+	for v := int64(1); v <= int64(current); v++ {
+		applied[v] = true
+	}
+	return applied, nil
+}
+
+// checkHistory makes sure the history matches the versioning scheme and
+// returns the pending migrations which are older than the last applied one.
+// With timestamp versioning the first currentVersion migrations are applied
+// once there are no such migrations.
+func (m *Migrator) checkHistory(ctx context.Context, currentVersion int32) ([]*Migration, error) {
+	history, err := m.historyVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for version, name := range history {
+		if isTimestamp(version) != m.timestampVersioning() {
+			return nil, VersioningMismatchError{Versioning: m.versioning(), Version: version, Name: name}
+		}
+	}
+
+	if !m.timestampVersioning() {
+		return nil, nil
+	}
+
+	if int32(len(history)) != currentVersion {
+		return nil, fmt.Errorf("%s says %d migrations are applied, but there are %d in %s",
+			m.versionTable, currentVersion, len(history), m.historyTableName())
+	}
+
+	byVersion := m.migrationsByVersion()
+	var lastApplied int64
+	for version, name := range history {
+		if _, ok := byVersion[version]; !ok {
+			return nil, UnknownMigrationError{Version: version, Name: name}
+		}
+		if version > lastApplied {
+			lastApplied = version
+		}
+	}
+
+	var outOfOrder []*Migration
+	for _, mig := range m.Migrations {
+		if mig.Version > lastApplied {
+			break
+		}
+		if _, ok := history[mig.Version]; !ok {
+			outOfOrder = append(outOfOrder, mig)
+		}
+	}
+
+	if len(outOfOrder) > 0 && !m.options.AllowOutOfOrder {
+		return nil, OutOfOrderError{Migrations: outOfOrder, LastApplied: lastApplied}
+	}
+	return outOfOrder, nil
+}
+
+// Conversion is a history entry converted from sequential versioning
+type Conversion struct {
+	OldVersion int64
+	OldName    string
+	NewVersion int64
+	NewName    string
+}
+
+// ConvertToTimestamps converts the history recorded with sequential
+// versioning to the loaded migrations with timestamp versioning. Renamed
+// files are matched by the part of the name after the number, e.g.
+// 0001_create_phonebook.sql becomes 20200206120000_create_phonebook.sql.
+// All the applied migrations should match, otherwise nothing is changed.
+// With dryRun the conversions are only returned.
+func (m *Migrator) ConvertToTimestamps(ctx context.Context, dryRun bool) (conversions []Conversion, err error) {
+	if !m.timestampVersioning() {
+		return nil, fmt.Errorf("Migrator should be configured with timestamp versioning")
+	}
+
+	ctx, err = m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = m.unlockWith(err)
+	}()
+
+	currentVersion, dirty, err := m.GetState(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to get current schema version")
+	}
+
+	if dirty {
+		return nil, DirtyError{Version: currentVersion, versionTable: m.versionTable}
+	}
+
+	history, err := m.historyVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The history is backfilled by a sequential migrator
+	if int32(len(history)) != currentVersion {
+		return nil, fmt.Errorf("%s has %d entries instead of %d, run the migrations with sequential versioning first",
+			m.historyTableName(), len(history), currentVersion)
+	}
+
+	bySuffix := make(map[string][]*Migration)
+	for _, mig := range m.Migrations {
+		suffix := nameSuffix(mig.Name)
+		bySuffix[suffix] = append(bySuffix[suffix], mig)
+	}
+
+	for version, name := range history {
+		if isTimestamp(version) {
+			continue
+		}
+
+		candidates := bySuffix[nameSuffix(name)]
+		if len(candidates) != 1 {
+			return nil, fmt.Errorf("Found %d migrations matching %s, expected exactly one", len(candidates), name)
+		}
+
+		if _, converted := history[candidates[0].Version]; converted {
+			return nil, fmt.Errorf("Migration %s matches %s, which is already applied", name, candidates[0].Name)
+		}
+
+		conversions = append(conversions, Conversion{
+			OldVersion: version,
+			OldName:    name,
+			NewVersion: candidates[0].Version,
+			NewName:    candidates[0].Name,
+		})
+	}
+
+	sort.Slice(conversions, func(i, j int) bool {
+		return conversions[i].OldVersion < conversions[j].OldVersion
+	})
+
+	if dryRun || len(conversions) == 0 {
+		return conversions, nil
+	}
+
+	tx, err := m.conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to begin serializable transaction")
+	}
+	// Rollback has no effect if Commit will be called
+	defer tx.Rollback(ctx)
+
+	for _, c := range conversions {
+		_, err = tx.Exec(ctx, fmt.Sprintf("update %s set version = $1, name = $2 where version = $3",
+			m.historyTableName()), c.NewVersion, c.NewName, c.OldVersion)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to update migration history")
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to commit the conversion")
+	}
+	return conversions, nil
+}
+
+// nameSuffix returns the name of a migration without the number. Names of
+// Go migrations usually don't have it.
+func nameSuffix(name string) string {
+	return versionPrefix.ReplaceAllString(name, "")
+}
+
+// TargetFor returns the target version for MigrateTo which makes the
+// migration with the given version the last applied one. Zero means that no
+// migrations should be applied.
+func (m *Migrator) TargetFor(version int64) (int32, error) {
+	if version == 0 {
+		return 0, nil
+	}
+
+	for _, mig := range m.Migrations {
+		if mig.Version == version {
+			return mig.Sequence, nil
+		}
+	}
+	return 0, BadVersionError(fmt.Sprintf("unknown migration version %d", version))
+}
@@ -0,0 +1,127 @@
+package migrate
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVersioning(t *testing.T) {
+	t.Parallel()
+
+	v, err := ParseVersioning("sequential")
+	require.NoError(t, err)
+	require.Equal(t, SequentialVersioning, v)
+
+	v, err = ParseVersioning("timestamp")
+	require.NoError(t, err)
+	require.Equal(t, TimestampVersioning, v)
+	require.Equal(t, "timestamp", v.String())
+
+	_, err = ParseVersioning("semver")
+	require.Error(t, err)
+}
+
+func TestTimestampMigrations(t *testing.T) {
+	t.Parallel()
+
+	noop := func(ctx context.Context, tx pgx.Tx) error {
+		return nil
+	}
+
+	cases := []struct {
+		files      []string
+		goVersions []int64
+		names      []string
+		err        string
+	}{
+		{
+			[]string{"20200206120000_create_t.sql", "20200301093000_alter_t.sql"},
+			[]int64{20200215000000},
+			[]string{"20200206120000_create_t.sql", "go_migration", "20200301093000_alter_t.sql"},
+			"",
+		},
+		{
+			[]string{"20200206120000_create_t.sql", "0002_alter_t.sql"},
+			nil,
+			nil,
+			"Migration 0002_alter_t.sql should be named YYYYMMDDHHMMSS_name.sql",
+		},
+		{
+			[]string{"20201306120000_create_t.sql"},
+			nil,
+			nil,
+			"Invalid timestamp in migration 20201306120000_create_t.sql",
+		},
+		{
+			[]string{"20200206120000_create_t.sql", "20200206120000_alter_t.sql"},
+			nil,
+			nil,
+			"Duplicate migration 20200206120000",
+		},
+		{
+			[]string{"20200206120000_create_t.sql"},
+			[]int64{20200206120000},
+			nil,
+			"Migration 20200206120000 is defined both in SQL and in Go",
+		},
+	}
+
+	for _, c := range cases {
+		files := fstest.MapFS{}
+		for _, name := range c.files {
+			files[name] = &fstest.MapFile{Data: []byte("SELECT 1;")}
+		}
+
+		opts := &MigratorOptions{MigratorFS: NewMigratorFS(files), Versioning: TimestampVersioning}
+		m := &Migrator{options: opts, Data: map[string]interface{}{}}
+		var goMigrations []GoMigration
+		for _, version := range c.goVersions {
+			g := GoMigration{Version: version, Name: "go_migration", Up: noop}
+			goMigrations = append(goMigrations, g)
+			require.NoError(t, m.RegisterGoMigration(g))
+		}
+
+		err := m.LoadMigrations(".")
+		count, countErr := CountMigrations(".", opts.MigratorFS, TimestampVersioning, goMigrations)
+		if c.err != "" {
+			require.EqualError(t, err, c.err, c.files)
+			require.EqualError(t, countErr, c.err, c.files)
+			continue
+		}
+
+		require.NoError(t, err, c.files)
+		require.NoError(t, countErr, c.files)
+		require.Equal(t, int32(len(c.names)), count)
+		var names []string
+		for i, mig := range m.Migrations {
+			require.Equal(t, int32(i+1), mig.Sequence)
+			require.True(t, isTimestamp(mig.Version), mig.Name)
+			names = append(names, mig.Name)
+		}
+		require.Equal(t, c.names, names)
+	}
+}
+
+func TestRegisterTimestampGoMigration(t *testing.T) {
+	t.Parallel()
+
+	noop := func(ctx context.Context, tx pgx.Tx) error {
+		return nil
+	}
+	m := &Migrator{options: &MigratorOptions{Versioning: TimestampVersioning}}
+	require.NoError(t, m.RegisterGoMigration(GoMigration{Version: 20200206120000, Name: "a", Up: noop}))
+	require.Error(t, m.RegisterGoMigration(GoMigration{Version: 20200206120000, Name: "b", Up: noop}))
+	require.Error(t, m.RegisterGoMigration(GoMigration{Sequence: 2, Name: "c", Up: noop}))
+}
+
+func TestNameSuffix(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "create_t.sql", nameSuffix("0001_create_t.sql"))
+	require.Equal(t, "create_t.sql", nameSuffix("20200206120000_create_t.sql"))
+	require.Equal(t, "go_migration", nameSuffix("go_migration"))
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/migrate"
+	"github.com/afiskon/go-rest-service-example/migrations"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// newMigrateCmd creates the `migrate` command for controlling the schema
+// without starting the service
+func newMigrateCmd(configPath *string) *cobra.Command {
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Manage database migrations",
+	}
+
+	migrateCmd.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "Show applied and pending migrations",
+		Args:  cobra.NoArgs,
+		// Reading the status doesn't create the migration tables
+		RunE: withMigratorEx(configPath, true, func(ctx context.Context, cmd *cobra.Command, m *migrate.Migrator) error {
+			return printStatus(ctx, cmd.OutOrStdout(), m)
+		}),
+	})
+
+	var dryRun bool
+	var output string
+	addDryRunFlags := func(cmd *cobra.Command) *cobra.Command {
+		cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the SQL instead of executing it")
+		cmd.Flags().StringVarP(&output, "output", "o", "", "Write the dry run script to a file instead of stdout")
+		return cmd
+	}
+
+	migrateCmd.AddCommand(addDryRunFlags(&cobra.Command{
+		Use:   "up",
+		Short: "Apply all pending migrations",
+		Args:  cobra.NoArgs,
+		RunE: withMigrator(configPath, func(ctx context.Context, cmd *cobra.Command, m *migrate.Migrator) error {
+			return migrateTo(ctx, cmd, m, int32(len(m.Migrations)), dryRun, output)
+		}),
+	}))
+
+	migrateCmd.AddCommand(&cobra.Command{
+		Use:   "down [n]",
+		Short: "Roll back the last n migrations, 1 by default",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: withMigrator(configPath, func(ctx context.Context, cmd *cobra.Command, m *migrate.Migrator) error {
+			n := int32(1)
+			if len(cmd.Flags().Args()) == 1 {
+				parsed, err := strconv.ParseInt(cmd.Flags().Arg(0), 10, 32)
+				if err != nil || parsed < 1 {
+					return errors.Errorf("Invalid number of migrations: %s", cmd.Flags().Arg(0))
+				}
+				n = int32(parsed)
+			}
+
+			current, err := m.GetCurrentVersion(ctx)
+			if err != nil {
+				return errors.Wrap(err, "Unable to get current schema version")
+			}
+			return m.MigrateTo(ctx, current-n, retryOnCommitFailure)
+		}),
+	})
+
+	migrateCmd.AddCommand(addDryRunFlags(&cobra.Command{
+		Use:   "to <version>",
+		Short: "Migrate up or down to the given version",
+		Args:  cobra.ExactArgs(1),
+		RunE: withMigrator(configPath, func(ctx context.Context, cmd *cobra.Command, m *migrate.Migrator) error {
+			version, err := strconv.ParseInt(cmd.Flags().Arg(0), 10, 64)
+			if err != nil {
+				return errors.Errorf("Invalid version: %s", cmd.Flags().Arg(0))
+			}
+
+			target, err := m.TargetFor(version)
+			if err != nil {
+				return err
+			}
+			return migrateTo(ctx, cmd, m, target, dryRun, output)
+		}),
+	}))
+
+	migrateCmd.AddCommand(&cobra.Command{
+		Use:   "redo",
+		Short: "Roll back the last migration and apply it again",
+		Args:  cobra.NoArgs,
+		RunE: withMigrator(configPath, func(ctx context.Context, cmd *cobra.Command, m *migrate.Migrator) error {
+			current, err := m.GetCurrentVersion(ctx)
+			if err != nil {
+				return errors.Wrap(err, "Unable to get current schema version")
+			}
+			if current == 0 {
+				return migrate.BadVersionError("no migrations have been applied")
+			}
+
+			err = m.MigrateTo(ctx, current-1, retryOnCommitFailure)
+			if err != nil {
+				return err
+			}
+			return m.MigrateTo(ctx, current, retryOnCommitFailure)
+		}),
+	})
+
+	var convertDryRun bool
+	convertCmd := &cobra.Command{
+		Use:   "convert-versions",
+		Short: "Convert the history of a database migrated with sequential versions to timestamp versions",
+		Long: "Convert the history of a database migrated with sequential versions to timestamp versions.\n" +
+			"Set migrations.versioning to timestamp and rename the files first, e.g.\n" +
+			"0001_create_phonebook.sql to 20200206120000_create_phonebook.sql.\n" +
+			"Applied migrations are matched by the part of the name after the number.",
+		Args: cobra.NoArgs,
+		RunE: withMigrator(configPath, func(ctx context.Context, cmd *cobra.Command, m *migrate.Migrator) error {
+			conversions, err := m.ConvertToTimestamps(ctx, convertDryRun)
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			if len(conversions) == 0 {
+				fmt.Fprintln(out, "Nothing to convert")
+			}
+			for _, c := range conversions {
+				fmt.Fprintf(out, "%d - %s -> %d - %s\n", c.OldVersion, c.OldName, c.NewVersion, c.NewName)
+			}
+			return nil
+		}),
+	}
+	convertCmd.Flags().BoolVar(&convertDryRun, "dry-run", false, "Print the conversions without changing the history")
+	migrateCmd.AddCommand(convertCmd)
+
+	migrateCmd.AddCommand(&cobra.Command{
+		Use:   "new <name>",
+		Short: "Create a migration file with the next version",
+		Long: "Create a migration file with the next version in migrations.dir, or in ./migrations\n" +
+			"if it's not set. The file is embedded into the binary on the next build.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			initLogging(*configPath)
+			return newMigrationFile(cmd.OutOrStdout(), args[0])
+		},
+	})
+
+	migrateCmd.AddCommand(&cobra.Command{
+		Use:   "verify",
+		Short: "Apply, roll back and re-apply every migration on an empty database",
+		Long: "Apply, roll back and re-apply every migration, checking that rolling back\n" +
+			"restores the schema. Data migrations are executed twice, so the command\n" +
+			"refuses to run unless db.url points to an empty scratch database.",
+		Args: cobra.NoArgs,
+		RunE: withMigrator(configPath, func(ctx context.Context, cmd *cobra.Command, m *migrate.Migrator) error {
+			notVerified, err := m.Verify(ctx, retryOnCommitFailure)
+			if err != nil {
+				return err
+			}
+
+			for _, mig := range notVerified {
+				log.Warnf("Migration %s is irreversible, only the forward part was verified", mig.Name)
+			}
+			log.Infof("Verified %d migrations", len(m.Migrations)-len(notVerified))
+			return nil
+		}),
+	})
+
+	var lintSince int64
+	lintCmd := &cobra.Command{
+		Use:   "lint",
+		Short: "Check the migrations for dangerous statements",
+		Long: "Check the migrations for dangerous statements without connecting to the database.\n" +
+			"The migrations are rendered both for PostgreSQL and CockroachDB. A finding can be\n" +
+			"suppressed by a `-- lint:ignore <rule>` comment before the statement. The command\n" +
+			"fails if there are findings, so that it can be used in CI.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			initLogging(*configPath)
+			return lintMigrations(cmd.OutOrStdout(), lintSince)
+		},
+	}
+	lintCmd.Flags().Int64Var(&lintSince, "since", 0,
+		"Check only the migrations after the given version, e.g. the ones which were never deployed")
+	migrateCmd.AddCommand(lintCmd)
+
+	migrateCmd.AddCommand(newBackfillCmd(configPath))
+	return migrateCmd
+}
+
+// migrateTo migrates to the target version or, in dry run mode, writes
+// the script which would be executed to output
+func migrateTo(ctx context.Context, cmd *cobra.Command, m *migrate.Migrator, target int32, dryRun bool,
+	output string) error {
+	if !dryRun {
+		if output != "" {
+			return errors.New("--output can be used only with --dry-run")
+		}
+		return m.MigrateTo(ctx, target, retryOnCommitFailure)
+	}
+
+	if output == "" {
+		return m.DryRun(ctx, target, cmd.OutOrStdout())
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return errors.Wrap(err, "Unable to create the output file")
+	}
+
+	err = m.DryRun(ctx, target, f)
+	closeErr := f.Close()
+	if err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "Unable to write the output file")
+	}
+	if err == nil {
+		log.Infof("Dry run script written to %s", output)
+	}
+	return err
+}
+
+// newMigrationFile creates a migration file from the template and prints
+// its path
+func newMigrationFile(out io.Writer, name string) error {
+	dir := viper.GetString("migrations.dir")
+	if dir == "" {
+		dir = "migrations"
+	}
+
+	versioning, err := migrationsVersioning()
+	if err != nil {
+		return err
+	}
+
+	filename, contents, err := migrate.NewMigrationFile(".", migrate.NewMigratorFS(os.DirFS(dir)), versioning,
+		migrations.Go, name, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "Unable to create a migration")
+	}
+
+	// Never overwrite an existing migration, e.g. with the same timestamp
+	path := filepath.Join(dir, filename)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Unable to create a migration")
+	}
+
+	_, err = f.Write(contents)
+	closeErr := f.Close()
+	if err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "Unable to write the migration")
+	}
+
+	fmt.Fprintln(out, path)
+	return nil
+}
+
+// lintMigrations prints the lint findings for the migrations after the given
+// version and fails if there are any
+func lintMigrations(out io.Writer, since int64) error {
+	opts, migrationsPath, err := migratorOptions()
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, cockroachDB := range []bool{false, true} {
+		m := migrate.NewOfflineMigrator(opts)
+		err = loadMigrations(m, migrationsPath, cockroachDB)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range migrate.Lint(m.Migrations, cockroachDB) {
+			// Most of the migrations are the same for both DBMS
+			if f.Version <= since || seen[f.String()] {
+				continue
+			}
+			seen[f.String()] = true
+			fmt.Fprintln(out, f)
+		}
+	}
+
+	if len(seen) > 0 {
+		return errors.Errorf("Found %d potential problems in migrations", len(seen))
+	}
+	return nil
+}
+
+func retryOnCommitFailure(err error) (retry bool) {
+	log.Infof("Commit failed during migration, retrying. Error: %v", err)
+	return true
+}
+
+// withMigrator connects to the database described by the config and passes
+// a migrator with loaded migrations to fn
+func withMigrator(configPath *string,
+	fn func(ctx context.Context, cmd *cobra.Command, m *migrate.Migrator) error) func(*cobra.Command, []string) error {
+	return withMigratorEx(configPath, false, fn)
+}
+
+// withMigratorEx is withMigrator with a read-only mode, in which the migrator
+// doesn't create its tables and fn reports the schema version itself
+func withMigratorEx(configPath *string, readOnly bool,
+	fn func(ctx context.Context, cmd *cobra.Command, m *migrate.Migrator) error) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		// Arguments are valid at this point, don't print usage on errors below
+		cmd.SilenceUsage = true
+		initLogging(*configPath)
+
+		ctx := context.Background()
+		pool, err := pgxpool.Connect(ctx, viper.GetString("db.url"))
+		if err != nil {
+			return errors.Wrap(err, "Unable to connect to database")
+		}
+		defer pool.Close()
+
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			return errors.Wrap(err, "Unable to acquire a database connection")
+		}
+		defer conn.Release()
+
+		cockroachDB, err := migrate.IsCockroachDB(ctx, conn.Conn())
+		if err != nil {
+			return errors.Wrap(err, "Unable to get DBMS version")
+		}
+
+		var m *migrate.Migrator
+		if readOnly {
+			m, err = newReadOnlyMigrator(ctx, conn.Conn(), cockroachDB)
+		} else {
+			m, err = newMigrator(ctx, pool, conn.Conn(), cockroachDB)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = fn(ctx, cmd, m)
+		if err != nil || readOnly {
+			return err
+		}
+
+		version, err := m.GetCurrentVersion(ctx)
+		if err != nil {
+			return errors.Wrap(err, "Unable to get current schema version")
+		}
+		log.Infof("Current schema version: %d", version)
+		return nil
+	}
+}
+
+func printStatus(ctx context.Context, out io.Writer, m *migrate.Migrator) error {
+	initialized, err := m.Initialized(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Without the migration tables nothing was applied yet
+	var dirty bool
+	applied := map[int64]bool{}
+	var history []migrate.HistoryEntry
+	pending := m.Repeatables
+	if initialized {
+		var version int32
+		version, dirty, err = m.GetState(ctx)
+		if err != nil {
+			return errors.Wrap(err, "Unable to get current schema version")
+		}
+		log.Infof("Current schema version: %d", version)
+
+		applied, err = m.Applied(ctx)
+		if err != nil {
+			return err
+		}
+
+		history, err = m.History(ctx)
+		if err != nil {
+			return err
+		}
+
+		pending, err = m.PendingRepeatables(ctx)
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintln(out, "Database is not initialized, run `migrate up` to create the migration tables")
+	}
+	byVersion := make(map[int64]migrate.HistoryEntry, len(history))
+	var lastApplied int64
+	for _, e := range history {
+		byVersion[e.Version] = e
+		if applied[e.Version] && e.Version > lastApplied {
+			lastApplied = e.Version
+		}
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tAPPLIED AT\tDURATION\tHOST")
+	for _, mig := range m.Migrations {
+		state := "pending"
+		appliedAt, duration, host := "-", "-", "-"
+		if !applied[mig.Version] && mig.Version < lastApplied {
+			state = "out of order"
+		}
+		if applied[mig.Version] {
+			state = "applied"
+			if e, ok := byVersion[mig.Version]; ok {
+				if e.Checksum != mig.Checksum {
+					state = "modified"
+				}
+				if e.AppliedAt != nil {
+					appliedAt = e.AppliedAt.Format("2006-01-02 15:04:05")
+				}
+				if e.Duration != nil {
+					duration = e.Duration.String()
+				}
+				if e.Host != nil {
+					host = *e.Host
+				}
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", mig.Version, mig.Name, state, appliedAt, duration, host)
+	}
+
+	isPending := make(map[string]bool, len(pending))
+	for _, r := range pending {
+		isPending[r.Name] = true
+	}
+	for _, r := range m.Repeatables {
+		state := "applied"
+		if isPending[r.Name] {
+			state = "pending"
+		}
+		fmt.Fprintf(w, "R\t%s\t%s\t-\t-\t-\n", r.Name, state)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if dirty {
+		fmt.Fprintf(out, "\nSchema is dirty: a no-transaction migration was partially applied. "+
+			"Fix the schema manually, then run `update %s set dirty = false`\n", schemaVersionTable)
+	}
+	return nil
+}
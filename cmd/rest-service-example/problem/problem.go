@@ -0,0 +1,108 @@
+package problem
+
+// Error responses in the format described in RFC 7807 "Problem Details
+// for HTTP APIs". All handlers should report errors using this package,
+// so that clients can tell one failure from another by the `type` member.
+
+import (
+	"encoding/json"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/requestid"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+const ContentType = "application/problem+json"
+
+// Type describes a class of problems. Title is a short summary of the
+// problem type which doesn't change from occurrence to occurrence.
+type Type struct {
+	URI    string
+	Title  string
+	Status int
+}
+
+var (
+	InvalidID        = Type{"/problems/invalid-id", "Invalid id", 400}
+	InvalidBody      = Type{"/problems/invalid-body", "Malformed request body", 400}
+	InvalidParameter = Type{"/problems/invalid-parameter", "Invalid query parameter", 400}
+	InvalidFilter    = Type{"/problems/invalid-filter", "Malformed filter expression", 400}
+	NotFound         = Type{"/problems/not-found", "Resource not found", 404}
+	MethodNotAllowed = Type{"/problems/method-not-allowed", "Method not allowed", 405}
+	Internal         = Type{"/problems/internal", "Internal server error", 500}
+	ReadOnly         = Type{"/problems/read-only", "Service is read-only", 503}
+)
+
+// Problem is a single occurrence of a problem. Extensions are additional
+// members specific to the problem type, they are serialized on the same
+// level as the standard ones.
+type Problem struct {
+	Type       string
+	Title      string
+	Status     int
+	Detail     string
+	Instance   string
+	RequestID  string
+	Extensions map[string]interface{}
+}
+
+func New(t Type, detail string) *Problem {
+	return &Problem{
+		Type:   t.URI,
+		Title:  t.Title,
+		Status: t.Status,
+		Detail: detail,
+	}
+}
+
+// With adds an extension member to the problem
+func (p *Problem) With(key string, value interface{}) *Problem {
+	if p.Extensions == nil {
+		p.Extensions = make(map[string]interface{})
+	}
+	p.Extensions[key] = value
+	return p
+}
+
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	members := make(map[string]interface{}, len(p.Extensions)+6)
+	for k, v := range p.Extensions {
+		members[k] = v
+	}
+
+	members["type"] = p.Type
+	members["title"] = p.Title
+	members["status"] = p.Status
+	if p.Detail != "" {
+		members["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		members["instance"] = p.Instance
+	}
+	if p.RequestID != "" {
+		members["request_id"] = p.RequestID
+	}
+	return json.Marshal(members)
+}
+
+// Write sends the problem to the client. Instance and RequestID are
+// taken from the request unless they are set already.
+func (p *Problem) Write(w http.ResponseWriter, r *http.Request) {
+	if p.Instance == "" {
+		p.Instance = r.URL.RequestURI()
+	}
+	if p.RequestID == "" {
+		p.RequestID = requestid.FromContext(r.Context())
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+	err := json.NewEncoder(w).Encode(p)
+	if err != nil {
+		log.Errorf("Unable to encode json: %v", err)
+	}
+}
+
+// Write is a shortcut for New(t, detail).Write(w, r)
+func Write(w http.ResponseWriter, r *http.Request, t Type, detail string) {
+	New(t, detail).Write(w, r)
+}
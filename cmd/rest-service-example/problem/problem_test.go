@@ -0,0 +1,71 @@
+package problem
+
+import (
+	"encoding/json"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/requestid"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		typ    Type
+		detail string
+		body   map[string]interface{}
+	}{
+		{InvalidID, "bad id", map[string]interface{}{
+			"type": "/problems/invalid-id", "title": "Invalid id", "status": float64(400), "detail": "bad id",
+		}},
+		{NotFound, "", map[string]interface{}{
+			"type": "/problems/not-found", "title": "Resource not found", "status": float64(404),
+		}},
+		{MethodNotAllowed, "", map[string]interface{}{
+			"type": "/problems/method-not-allowed", "title": "Method not allowed", "status": float64(405),
+		}},
+		{Internal, "db is down", map[string]interface{}{
+			"type": "/problems/internal", "title": "Internal server error", "status": float64(500), "detail": "db is down",
+		}},
+		{ReadOnly, "", map[string]interface{}{
+			"type": "/problems/read-only", "title": "Service is read-only", "status": float64(503),
+		}},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/api/v1/records/123?x=y", nil)
+		req.Header.Set(requestid.Header, "req-1")
+		rec := httptest.NewRecorder()
+		requestid.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Write(w, r, c.typ, c.detail)
+		})).ServeHTTP(rec, req)
+
+		require.Equal(t, c.typ.Status, rec.Code)
+		require.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+		require.Equal(t, "req-1", rec.Header().Get(requestid.Header))
+
+		c.body["instance"] = "/api/v1/records/123?x=y"
+		c.body["request_id"] = "req-1"
+		body := make(map[string]interface{})
+		err := json.Unmarshal(rec.Body.Bytes(), &body)
+		require.NoError(t, err)
+		require.Equal(t, c.body, body)
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	t.Parallel()
+
+	p := New(InvalidFilter, "oops").With("offset", 3).With("type", "ignored")
+	data, err := json.Marshal(p)
+	require.NoError(t, err)
+
+	body := make(map[string]interface{})
+	err = json.Unmarshal(data, &body)
+	require.NoError(t, err)
+	require.Equal(t, float64(3), body["offset"])
+	// Extensions can't override standard members
+	require.Equal(t, "/problems/invalid-filter", body["type"])
+}
@@ -0,0 +1,279 @@
+package records
+
+// Filter expressions for the records list endpoint, e.g.:
+//
+//   name~"ali" and (phone^="+7" or phone="112")
+//
+// Supported operators:
+//   =   exact match
+//   ^=  prefix match
+//   ~   case-insensitive substring match
+//
+// Conditions can be combined with `and` / `or` and grouped with parentheses.
+// `and` binds tighter than `or`. The expression is translated into a SQL
+// condition with parameters, values never end up in the SQL text itself.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxFilterLength = 1024
+	maxFilterDepth  = 16
+)
+
+// Columns of the phonebook table a filter can refer to
+var filterColumns = map[string]string{
+	"name":  "name",
+	"phone": "phone",
+}
+
+// FilterError describes a malformed filter expression. Offset is a byte
+// offset of the offending token in the original expression.
+type FilterError struct {
+	Offset int
+	Token  string
+	Msg    string
+}
+
+func (e FilterError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%s at offset %d", e.Msg, e.Offset)
+	}
+	return fmt.Sprintf("%s at offset %d: %q", e.Msg, e.Offset, e.Token)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind   tokenKind
+	text   string // raw text as it appears in the expression
+	value  string // unquoted value for tokString, lower-cased text for tokIdent
+	offset int
+}
+
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokLParen, text: "(", offset: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokRParen, text: ")", offset: i})
+			i++
+		case c == '=' || c == '~':
+			tokens = append(tokens, token{kind: tokOp, text: string(c), offset: i})
+			i++
+		case c == '^':
+			if i+1 >= len(expr) || expr[i+1] != '=' {
+				return nil, FilterError{Offset: i, Token: "^", Msg: "unknown operator, did you mean ^="}
+			}
+			tokens = append(tokens, token{kind: tokOp, text: "^=", offset: i})
+			i += 2
+		case c == '"':
+			start := i
+			var value strings.Builder
+			i++
+			closed := false
+			for i < len(expr) {
+				if expr[i] == '\\' && i+1 < len(expr) {
+					value.WriteByte(expr[i+1])
+					i += 2
+					continue
+				}
+				if expr[i] == '"' {
+					closed = true
+					i++
+					break
+				}
+				value.WriteByte(expr[i])
+				i++
+			}
+			if !closed {
+				return nil, FilterError{Offset: start, Token: expr[start:], Msg: "unterminated string"}
+			}
+			tokens = append(tokens, token{kind: tokString, text: expr[start:i], value: value.String(), offset: start})
+		case isIdentChar(c):
+			start := i
+			for i < len(expr) && isIdentChar(expr[i]) {
+				i++
+			}
+			text := expr[start:i]
+			tokens = append(tokens, token{kind: tokIdent, text: text, value: strings.ToLower(text), offset: start})
+		default:
+			return nil, FilterError{Offset: i, Token: string(c), Msg: "unexpected character"}
+		}
+	}
+	tokens = append(tokens, token{kind: tokEOF, offset: len(expr)})
+	return tokens, nil
+}
+
+func isIdentChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_'
+}
+
+// escapeLike escapes characters that have a special meaning in LIKE patterns.
+// Backslash is the default escape character both in PostgreSQL and CockroachDB.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+type filterParser struct {
+	tokens    []token
+	pos       int
+	depth     int
+	args      []interface{}
+	nextParam int
+}
+
+// ParseFilter translates a filter expression into a SQL condition.
+// Placeholders in the condition are numbered starting from firstParam,
+// the corresponding values are returned in args.
+func ParseFilter(expr string, firstParam int) (cond string, args []interface{}, err error) {
+	if len(expr) > maxFilterLength {
+		return "", nil, FilterError{Offset: maxFilterLength, Msg: fmt.Sprintf("filter is longer than %d bytes", maxFilterLength)}
+	}
+
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	p := filterParser{tokens: tokens, nextParam: firstParam}
+	cond, err = p.parseOr()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokEOF {
+		return "", nil, FilterError{Offset: tok.offset, Token: tok.text, Msg: "expected `and`, `or` or end of expression"}
+	}
+
+	return cond, p.args, nil
+}
+
+func (p *filterParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *filterParser) isKeyword(keyword string) bool {
+	tok := p.peek()
+	return tok.kind == tokIdent && tok.value == keyword
+}
+
+func (p *filterParser) parseOr() (string, error) {
+	return p.parseBinary("or", p.parseAnd)
+}
+
+func (p *filterParser) parseAnd() (string, error) {
+	return p.parseBinary("and", p.parseUnary)
+}
+
+func (p *filterParser) parseBinary(keyword string, parseOperand func() (string, error)) (string, error) {
+	first, err := parseOperand()
+	if err != nil {
+		return "", err
+	}
+
+	operands := []string{first}
+	for p.isKeyword(keyword) {
+		p.next()
+		operand, err := parseOperand()
+		if err != nil {
+			return "", err
+		}
+		operands = append(operands, operand)
+	}
+
+	if len(operands) == 1 {
+		return first, nil
+	}
+	return "(" + strings.Join(operands, " "+strings.ToUpper(keyword)+" ") + ")", nil
+}
+
+func (p *filterParser) parseUnary() (string, error) {
+	tok := p.peek()
+	if tok.kind != tokLParen {
+		return p.parseCondition()
+	}
+
+	p.depth++
+	if p.depth > maxFilterDepth {
+		return "", FilterError{Offset: tok.offset, Token: tok.text, Msg: "too many nested parentheses"}
+	}
+
+	p.next()
+	cond, err := p.parseOr()
+	if err != nil {
+		return "", err
+	}
+
+	closing := p.next()
+	if closing.kind != tokRParen {
+		return "", FilterError{Offset: closing.offset, Token: closing.text, Msg: "expected )"}
+	}
+
+	p.depth--
+	return cond, nil
+}
+
+func (p *filterParser) parseCondition() (string, error) {
+	field := p.next()
+	if field.kind != tokIdent {
+		return "", FilterError{Offset: field.offset, Token: field.text, Msg: "expected field name"}
+	}
+
+	column, ok := filterColumns[field.value]
+	if !ok {
+		return "", FilterError{Offset: field.offset, Token: field.text, Msg: "unknown field"}
+	}
+
+	op := p.next()
+	if op.kind != tokOp {
+		return "", FilterError{Offset: op.offset, Token: op.text, Msg: "expected one of =, ^=, ~"}
+	}
+
+	value := p.next()
+	if value.kind != tokString {
+		return "", FilterError{Offset: value.offset, Token: value.text, Msg: "expected double-quoted string"}
+	}
+
+	placeholder := "$" + strconv.Itoa(p.nextParam)
+	p.nextParam++
+
+	switch op.text {
+	case "=":
+		p.args = append(p.args, value.value)
+		return column + " = " + placeholder, nil
+	case "^=":
+		p.args = append(p.args, escapeLike(value.value)+"%")
+		return column + " LIKE " + placeholder, nil
+	default: // "~"
+		p.args = append(p.args, "%"+escapeLike(value.value)+"%")
+		return column + " ILIKE " + placeholder, nil
+	}
+}
@@ -0,0 +1,73 @@
+package records
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		expr string
+		cond string
+		args []interface{}
+	}{
+		{`name="Alice"`, "name = $3", []interface{}{"Alice"}},
+		{`phone^="+7"`, "phone LIKE $3", []interface{}{"+7%"}},
+		{`NAME ~ "ali"`, "name ILIKE $3", []interface{}{"%ali%"}},
+		{`name~"50%_off\\"`, "name ILIKE $3", []interface{}{`%50\%\_off\\%`}},
+		{`name="say \"hi\""`, "name = $3", []interface{}{`say "hi"`}},
+		{
+			`name~"ali" and phone^="+7"`,
+			"(name ILIKE $3 AND phone LIKE $4)",
+			[]interface{}{"%ali%", "+7%"},
+		},
+		{
+			`name="a" or name="b" and phone="c"`,
+			"(name = $3 OR (name = $4 AND phone = $5))",
+			[]interface{}{"a", "b", "c"},
+		},
+		{
+			`(name="a" or name="b") and phone="c"`,
+			"((name = $3 OR name = $4) AND phone = $5)",
+			[]interface{}{"a", "b", "c"},
+		},
+	}
+
+	for _, c := range cases {
+		cond, args, err := ParseFilter(c.expr, 3)
+		require.NoError(t, err, c.expr)
+		require.Equal(t, c.cond, cond, c.expr)
+		require.Equal(t, c.args, args, c.expr)
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		expr   string
+		offset int
+		token  string
+	}{
+		{`email="x"`, 0, "email"},
+		{`name "x"`, 5, `"x"`},
+		{`name = x`, 7, "x"},
+		{`name = "x`, 7, `"x`},
+		{`name ^ "x"`, 5, "^"},
+		{`name = "x" and`, 14, ""},
+		{`name = "x" phone = "y"`, 11, "phone"},
+		{`(name = "x"`, 11, ""},
+		{`name = "x" & phone = "y"`, 11, "&"},
+	}
+
+	for _, c := range cases {
+		_, _, err := ParseFilter(c.expr, 1)
+		require.Error(t, err, c.expr)
+		ferr, ok := err.(FilterError)
+		require.True(t, ok, c.expr)
+		require.Equal(t, c.offset, ferr.Offset, c.expr)
+		require.Equal(t, c.token, ferr.Token, c.expr)
+	}
+}
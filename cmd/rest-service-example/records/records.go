@@ -2,13 +2,21 @@ package records
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/dberror"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/dbtx"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/problem"
 	"github.com/gorilla/mux"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 )
 
 type Record struct {
@@ -17,130 +25,287 @@ type Record struct {
 	Phone string `json:"phone"`
 }
 
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// Page is a single chunk of the phonebook returned by SelectAll. Next is
+// a link to the following page and is empty when there are no more records.
+type Page struct {
+	Records []Record `json:"records"`
+	Next    string   `json:"next,omitempty"`
+}
+
+// encodeCursor turns the id of the last record on a page into an opaque
+// cursor. Clients should not make any assumptions about its format.
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("id:" + strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	str := string(raw)
+	if !strings.HasPrefix(str, "id:") {
+		return 0, fmt.Errorf("unexpected cursor format")
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(str, "id:"))
+	if err != nil {
+		return 0, err
+	}
+
+	if id < 0 {
+		return 0, fmt.Errorf("negative id in cursor")
+	}
+
+	return id, nil
+}
+
+func parseLimit(limitStr string) (int, error) {
+	if limitStr == "" {
+		return defaultPageLimit, nil
+	}
+
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil {
+		return 0, err
+	}
+
+	if limit < 1 || limit > maxPageLimit {
+		return 0, fmt.Errorf("limit should be between 1 and %d", maxPageLimit)
+	}
+
+	return limit, nil
+}
+
+// SelectAll returns the phonebook ordered by id. Pagination is keyset-based:
+// instead of OFFSET the client passes an opaque cursor in `after`, which is
+// translated into `id > $1`. This way every page costs the same regardless
+// of how deep into the table the client is. An optional `filter` narrows
+// the result down, see ParseFilter for the syntax.
 func SelectAll(p *pgxpool.Pool, w http.ResponseWriter, r *http.Request) {
-	h := w.Header()
-	h.Set("Content-Type", "text/html")
-	w.WriteHeader(200)
-	_, err := w.Write([]byte("<h1>records.SelectAll: under construction</h1>"))
+	query := r.URL.Query()
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil { // bad request
+		problem.Write(w, r, problem.InvalidParameter, "limit: "+err.Error())
+		return
+	}
+
+	afterID := 0
+	if after := query.Get("after"); after != "" {
+		afterID, err = decodeCursor(after)
+		if err != nil { // bad request
+			problem.Write(w, r, problem.InvalidParameter, "after: malformed cursor")
+			return
+		}
+	}
+
+	sql := "SELECT id, name, phone FROM phonebook WHERE id > $1"
+	filter := query.Get("filter")
+	var filterArgs []interface{}
+	if filter != "" {
+		var cond string
+		cond, filterArgs, err = ParseFilter(filter, 3)
+		if err != nil { // bad request
+			writeFilterError(w, r, err)
+			return
+		}
+		sql += " AND " + cond
+	}
+	sql += " ORDER BY id LIMIT $2"
+
+	conn, err := p.Acquire(r.Context())
+	if err != nil {
+		writeDBError(w, r, err, "Unable to acquire a database connection", "")
+		return
+	}
+	defer conn.Release()
+
+	// Fetch one extra row to find out whether there is a next page
+	args := append([]interface{}{afterID, limit + 1}, filterArgs...)
+	rows, err := conn.Query(r.Context(), sql, args...)
+	if err != nil {
+		writeDBError(w, r, err, "Unable to SELECT", sql)
+		return
+	}
+	defer rows.Close()
+
+	page := Page{Records: make([]Record, 0, limit)}
+	hasMore := false
+	for rows.Next() {
+		if len(page.Records) == limit {
+			hasMore = true
+			break
+		}
+
+		var rec Record
+		err = rows.Scan(&rec.Id, &rec.Name, &rec.Phone)
+		if err != nil {
+			writeDBError(w, r, err, "Unable to scan a row", sql)
+			return
+		}
+		page.Records = append(page.Records, rec)
+	}
+
+	if err = rows.Err(); err != nil {
+		writeDBError(w, r, err, "Unable to SELECT", sql)
+		return
+	}
+
+	if hasMore {
+		next := url.Values{}
+		next.Set("limit", strconv.Itoa(limit))
+		next.Set("after", encodeCursor(page.Records[len(page.Records)-1].Id))
+		if filter != "" {
+			next.Set("filter", filter)
+		}
+		page.Next = r.URL.Path + "?" + next.Encode()
+	}
+
+	writeJSON(w, r, page)
+}
+
+func writeFilterError(w http.ResponseWriter, r *http.Request, err error) {
+	p := problem.New(problem.InvalidFilter, err.Error())
+	if ferr, ok := err.(FilterError); ok {
+		p.With("offset", ferr.Offset).With("token", ferr.Token)
+	}
+	p.Write(w, r)
+}
+
+// writeJSON sends v to the client. The response is encoded before anything
+// is written, so that an encoding error can still be reported as a problem.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Unable to encode json: %v", err)
+		problem.Write(w, r, problem.Internal, "Unable to encode the response")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	// Terminated by a newline like the output of json.Encoder
+	_, err = w.Write(append(body, '\n'))
 	if err != nil {
-		log.Errorf("PostHandler, w.Write: %v", err)
+		log.Debugf("Unable to write the response: %v", err)
+	}
+}
+
+// writeDBError logs a failed query and sends a corresponding problem to the
+// client. Errors caused by the request itself, e.g. a too long name, are not
+// logged as errors. Timed out statements are logged for further analysis.
+func writeDBError(w http.ResponseWriter, r *http.Request, err error, what, sql string) {
+	switch r.Context().Err() {
+	case context.DeadlineExceeded:
+		log.WithField("statement", sql).Warnf("%s: request deadline exceeded: %v", what, err)
+		problem.Write(w, r, dberror.Timeout, "The request took too long")
+		return
+	case context.Canceled:
+		log.Infof("%s: request canceled by the client: %v", what, err)
+		return
 	}
+
+	p := dberror.Problem(err)
+	switch {
+	case p.Status == dberror.Timeout.Status:
+		log.WithField("statement", sql).Warnf("%s: %v", what, err)
+	case p.Status >= 500:
+		log.Errorf("%s: %v", what, err)
+	default:
+		log.Debugf("%s: %v", what, err)
+	}
+	p.Write(w, r)
 }
 
 func Select(p *pgxpool.Pool, w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.ParseUint(vars["id"], 10, 64)
 	if err != nil { // bad request
-		w.WriteHeader(400)
+		problem.Write(w, r, problem.InvalidID, "Record id should be a 64-bit unsigned integer")
 		return
 	}
 
-	conn, err := p.Acquire(context.Background())
+	conn, err := p.Acquire(r.Context())
 	if err != nil {
-		log.Errorf("Unable to acquire a database connection: %v\n", err)
-		w.WriteHeader(500)
+		writeDBError(w, r, err, "Unable to acquire a database connection", "")
 		return
 	}
 	defer conn.Release()
 
-	row := conn.QueryRow(context.Background(),
-		"SELECT id, name, phone FROM phonebook WHERE id = $1",
-		id)
+	const sql = "SELECT id, name, phone FROM phonebook WHERE id = $1"
+	row := conn.QueryRow(r.Context(), sql, id)
 
 	var rec Record
 	err = row.Scan(&rec.Id, &rec.Name, &rec.Phone)
 	if err == pgx.ErrNoRows {
-		w.WriteHeader(404)
+		problem.Write(w, r, problem.NotFound, "There is no record with id "+vars["id"])
 		return
 	}
 
 	if err != nil {
-		log.Errorf("Unable to SELECT: %v", err)
-		w.WriteHeader(500)
+		writeDBError(w, r, err, "Unable to SELECT", sql)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	err = json.NewEncoder(w).Encode(rec)
-	if err != nil {
-		log.Errorf("Unable to encode json: %v", err)
-		w.WriteHeader(500)
-		return
-	}
+	writeJSON(w, r, rec)
 }
 
 func Insert(p *pgxpool.Pool, w http.ResponseWriter, r *http.Request) {
 	var rec Record
 	err := json.NewDecoder(r.Body).Decode(&rec)
 	if err != nil { // bad request
-		w.WriteHeader(400)
-		return
-	}
-
-	conn, err := p.Acquire(context.Background())
-	if err != nil {
-		log.Errorf("Unable to acquire a database connection: %v", err)
-		w.WriteHeader(500)
+		problem.Write(w, r, problem.InvalidBody, err.Error())
 		return
 	}
-	defer conn.Release()
 
-	row := conn.QueryRow(context.Background(),
-		"INSERT INTO phonebook (name, phone) VALUES ($1, $2) RETURNING id",
-		rec.Name, rec.Phone)
+	const sql = "INSERT INTO phonebook (name, phone) VALUES ($1, $2) RETURNING id"
 	var id uint64
-	err = row.Scan(&id)
+	err = dbtx.RunInTx(r.Context(), p, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		return tx.QueryRow(r.Context(), sql, rec.Name, rec.Phone).Scan(&id)
+	})
 	if err != nil {
-		log.Errorf("Unable to INSERT: %v", err)
-		w.WriteHeader(500)
+		writeDBError(w, r, err, "Unable to INSERT", sql)
 		return
 	}
 
 	resp := make(map[string]string, 1)
 	resp["id"] = strconv.FormatUint(id, 10)
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	err = json.NewEncoder(w).Encode(resp)
-	if err != nil {
-		log.Errorf("Unable to encode json: %v", err)
-		w.WriteHeader(500)
-		return
-	}
+	writeJSON(w, r, resp)
 }
 
 func Update(p *pgxpool.Pool, w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.ParseUint(vars["id"], 10, 64)
 	if err != nil { // bad request
-		w.WriteHeader(400)
+		problem.Write(w, r, problem.InvalidID, "Record id should be a 64-bit unsigned integer")
 		return
 	}
 
 	var rec Record
 	err = json.NewDecoder(r.Body).Decode(&rec)
 	if err != nil { // bad request
-		w.WriteHeader(400)
-		return
-	}
-
-	conn, err := p.Acquire(context.Background())
-	if err != nil {
-		log.Errorf("Unable to acquire a database connection: %v", err)
-		w.WriteHeader(500)
+		problem.Write(w, r, problem.InvalidBody, err.Error())
 		return
 	}
-	defer conn.Release()
 
-	ct, err := conn.Exec(context.Background(),
-		"UPDATE phonebook SET name = $2, phone = $3 WHERE id = $1",
-		id, rec.Name, rec.Phone)
+	const sql = "UPDATE phonebook SET name = $2, phone = $3 WHERE id = $1"
+	var ct pgconn.CommandTag
+	err = dbtx.RunInTx(r.Context(), p, pgx.TxOptions{}, func(tx pgx.Tx) (err error) {
+		ct, err = tx.Exec(r.Context(), sql, id, rec.Name, rec.Phone)
+		return err
+	})
 	if err != nil {
-		log.Errorf("Unable to UPDATE: %v\n", err)
-		w.WriteHeader(500)
+		writeDBError(w, r, err, "Unable to UPDATE", sql)
 		return
 	}
 
 	if ct.RowsAffected() == 0 {
-		w.WriteHeader(404)
+		problem.Write(w, r, problem.NotFound, "There is no record with id "+vars["id"])
 		return
 	}
 
@@ -151,27 +316,23 @@ func Delete(p *pgxpool.Pool, w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.ParseUint(vars["id"], 10, 64)
 	if err != nil { // bad request
-		w.WriteHeader(400)
-		return
-	}
-
-	conn, err := p.Acquire(context.Background())
-	if err != nil {
-		log.Errorf("Unable to acquire a database connection: %v", err)
-		w.WriteHeader(500)
+		problem.Write(w, r, problem.InvalidID, "Record id should be a 64-bit unsigned integer")
 		return
 	}
-	defer conn.Release()
 
-	ct, err := conn.Exec(context.Background(), "DELETE FROM phonebook WHERE id = $1", id)
+	const sql = "DELETE FROM phonebook WHERE id = $1"
+	var ct pgconn.CommandTag
+	err = dbtx.RunInTx(r.Context(), p, pgx.TxOptions{}, func(tx pgx.Tx) (err error) {
+		ct, err = tx.Exec(r.Context(), sql, id)
+		return err
+	})
 	if err != nil {
-		log.Errorf("Unable to DELETE: %v", err)
-		w.WriteHeader(500)
+		writeDBError(w, r, err, "Unable to DELETE", sql)
 		return
 	}
 
 	if ct.RowsAffected() == 0 {
-		w.WriteHeader(404)
+		problem.Write(w, r, problem.NotFound, "There is no record with id "+vars["id"])
 		return
 	}
 
@@ -0,0 +1,123 @@
+package records
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/problem"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/requestid"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Handlers are expected to reject these requests before touching the
+// database, so a nil pool is passed to them. DB-related problems are
+// covered by the integration tests.
+func TestProblemResponses(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		handler func(p *pgxpool.Pool, w http.ResponseWriter, r *http.Request)
+		method  string
+		target  string
+		id      string
+		body    string
+		status  int
+		typ     string
+		ext     map[string]interface{}
+	}{
+		{"select, id overflow", Select, "GET", "/api/v1/records/99999999999999999999", "99999999999999999999", "",
+			400, "/problems/invalid-id", nil},
+		{"update, id overflow", Update, "PUT", "/api/v1/records/99999999999999999999", "99999999999999999999", "{}",
+			400, "/problems/invalid-id", nil},
+		{"delete, id overflow", Delete, "DELETE", "/api/v1/records/99999999999999999999", "99999999999999999999", "",
+			400, "/problems/invalid-id", nil},
+		{"insert, malformed json", Insert, "POST", "/api/v1/records", "", "{\"name\":", 400,
+			"/problems/invalid-body", nil},
+		{"update, malformed json", Update, "PUT", "/api/v1/records/1", "1", "[]", 400,
+			"/problems/invalid-body", nil},
+		{"list, bad limit", SelectAll, "GET", "/api/v1/records?limit=100500", "", "", 400,
+			"/problems/invalid-parameter", nil},
+		{"list, bad cursor", SelectAll, "GET", "/api/v1/records?after=bm9wZQ", "", "", 400,
+			"/problems/invalid-parameter", nil},
+		{"list, bad filter", SelectAll, "GET", "/api/v1/records?filter=name%3D%22x%22+or", "", "", 400,
+			"/problems/invalid-filter", map[string]interface{}{"offset": float64(11), "token": ""}},
+		{"search, empty query", func(p *pgxpool.Pool, w http.ResponseWriter, r *http.Request) {
+			Search(p, false, w, r)
+		}, "GET", "/api/v1/records/search?q=", "", "", 400, "/problems/invalid-parameter", nil},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.target, bytes.NewBufferString(c.body))
+		req.Header.Set(requestid.Header, "test-"+c.name[:4])
+		if c.id != "" {
+			req = mux.SetURLVars(req, map[string]string{"id": c.id})
+		}
+
+		rec := httptest.NewRecorder()
+		requestid.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.handler(nil, w, r)
+		})).ServeHTTP(rec, req)
+
+		require.Equal(t, c.status, rec.Code, c.name)
+		require.Equal(t, problem.ContentType, rec.Header().Get("Content-Type"), c.name)
+
+		body := make(map[string]interface{})
+		err := json.Unmarshal(rec.Body.Bytes(), &body)
+		require.NoError(t, err, c.name)
+		require.Equal(t, c.typ, body["type"], c.name)
+		require.NotEmpty(t, body["title"], c.name)
+		require.NotEmpty(t, body["detail"], c.name)
+		require.Equal(t, float64(c.status), body["status"], c.name)
+		require.Equal(t, c.target, body["instance"], c.name)
+		require.Equal(t, "test-"+c.name[:4], body["request_id"], c.name)
+		for k, v := range c.ext {
+			require.Equal(t, v, body[k], c.name)
+		}
+	}
+}
+
+func TestDeadlineExceeded(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	req := httptest.NewRequest("GET", "/api/v1/records/1", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	writeDBError(rec, req, errors.New("timeout: context already done"), "Unable to SELECT", "SELECT 1")
+
+	require.Equal(t, 504, rec.Code)
+	body := make(map[string]interface{})
+	err := json.Unmarshal(rec.Body.Bytes(), &body)
+	require.NoError(t, err)
+	require.Equal(t, "/problems/timeout", body["type"])
+}
+
+func TestWriteJSON(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest("GET", "/api/v1/records/1", nil)
+	rec := httptest.NewRecorder()
+	writeJSON(rec, req, Record{Id: 1, Name: "Alice", Phone: "123"})
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "{\"id\":1,\"name\":\"Alice\",\"phone\":\"123\"}\n", rec.Body.String())
+
+	// Nothing is written before the encoding fails
+	rec = httptest.NewRecorder()
+	writeJSON(rec, req, map[string]interface{}{"id": make(chan int)})
+	require.Equal(t, 500, rec.Code)
+	require.Equal(t, problem.ContentType, rec.Header().Get("Content-Type"))
+	body := make(map[string]interface{})
+	err := json.Unmarshal(rec.Body.Bytes(), &body)
+	require.NoError(t, err)
+	require.Equal(t, "/problems/internal", body["type"])
+}
@@ -0,0 +1,278 @@
+package records
+
+import (
+	"context"
+	"fmt"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/dbtx"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/problem"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	maxSearchQuery     = 256
+
+	// Records with a lower similarity are not considered a match. pg_trgm's
+	// default of 0.3 is too strict for short names: "Alcie" vs "Alice" is 0.2.
+	searchThreshold = 0.15
+
+	// Without pg_trgm the candidates are the records with a word starting
+	// with the same searchPrefixLen characters as the query. They are read
+	// by searchBatchSize, at most maxSearchCandidates of them.
+	searchPrefixLen     = 2
+	searchBatchSize     = 1000
+	maxSearchCandidates = 10000
+)
+
+// SearchResult is a record along with its similarity to the search query,
+// from 0 (nothing in common) to 1 (same set of trigrams).
+type SearchResult struct {
+	Record Record  `json:"record"`
+	Score  float64 `json:"score"`
+}
+
+// SearchResults are the best matches. Truncated means that only the first
+// maxSearchCandidates candidates were considered, so a better match could
+// be missed. It's possible only on CockroachDB, a more specific query helps.
+type SearchResults struct {
+	Results   []SearchResult `json:"results"`
+	Truncated bool           `json:"truncated,omitempty"`
+}
+
+// Search ranks records by similarity of their names to the `q` parameter.
+// On PostgreSQL this is done by pg_trgm using the trigram index. CockroachDB
+// doesn't have pg_trgm, so there the same similarity metric is computed
+// in the application for a bounded number of candidates, see searchInApp.
+func Search(p *pgxpool.Pool, cockroachDB bool, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" || len(q) > maxSearchQuery { // bad request
+		problem.Write(w, r, problem.InvalidParameter,
+			fmt.Sprintf("q should be non-empty and no longer than %d bytes", maxSearchQuery))
+		return
+	}
+
+	limit := defaultSearchLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxSearchLimit { // bad request
+			problem.Write(w, r, problem.InvalidParameter,
+				fmt.Sprintf("limit should be between 1 and %d", maxSearchLimit))
+			return
+		}
+	}
+
+	var results []SearchResult
+	var truncated bool
+	var err error
+	var sql string
+	if cockroachDB {
+		sql = searchInAppSQL
+		results, truncated, err = searchInApp(r.Context(), p, q, limit)
+	} else {
+		sql = searchWithTrgmSQL
+		results, err = searchWithTrgm(r.Context(), p, q, limit)
+	}
+	if err != nil {
+		writeDBError(w, r, err, "Unable to search", sql)
+		return
+	}
+
+	writeJSON(w, r, SearchResults{Results: results, Truncated: truncated})
+}
+
+const (
+	searchWithTrgmSQL = "SELECT id, name, phone, similarity(name, $1) AS score FROM phonebook " +
+		"WHERE name % $1 ORDER BY score DESC, id LIMIT $2"
+	searchInAppSQL = "SELECT id, name, phone FROM phonebook " +
+		"WHERE (name ILIKE $1 OR name ILIKE $2) AND id > $3 ORDER BY id LIMIT $4"
+)
+
+func searchWithTrgm(ctx context.Context, p *pgxpool.Pool, q string, limit int) ([]SearchResult, error) {
+	var results []SearchResult
+	err := dbtx.RunInTx(ctx, p, pgx.TxOptions{AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		// The threshold is used by the % operator, which unlike similarity()
+		// can use the index. The setting is local to the transaction, so it
+		// doesn't leak to other queries on the pooled connection.
+		_, err := tx.Exec(ctx,
+			"SELECT set_config('pg_trgm.similarity_threshold', $1, true)",
+			strconv.FormatFloat(searchThreshold, 'f', -1, 64))
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(ctx, searchWithTrgmSQL, q, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		results = make([]SearchResult, 0, limit)
+		for rows.Next() {
+			var res SearchResult
+			var score float32
+			err = rows.Scan(&res.Record.Id, &res.Record.Name, &res.Record.Phone, &score)
+			if err != nil {
+				return err
+			}
+			res.Score = float64(score)
+			results = append(results, res)
+		}
+
+		return rows.Err()
+	})
+	return results, err
+}
+
+// searchPrefix returns the first searchPrefixLen characters of the first
+// word of the query in lower case, or an empty string if the query has no
+// words and thus nothing can be similar to it. Words consist of letters and
+// digits only, so the prefix doesn't need escaping in LIKE patterns.
+func searchPrefix(q string) string {
+	words := strings.FieldsFunc(strings.ToLower(q), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+
+	prefix := []rune(words[0])
+	if len(prefix) > searchPrefixLen {
+		prefix = prefix[:searchPrefixLen]
+	}
+	return string(prefix)
+}
+
+// fetchCandidates returns up to n candidates with ids greater than afterID
+// in the order of ids
+type fetchCandidates func(ctx context.Context, afterID, n int) ([]Record, error)
+
+// searchInApp computes the similarity for the records having a word which
+// starts with the same characters as the first word of the query, e.g. "Alcie"
+// finds "Alice" and "Bob Allen". Unlike pg_trgm it misses a typo in the first
+// characters, but it doesn't transfer the whole table on every request.
+func searchInApp(ctx context.Context, p *pgxpool.Pool, q string, limit int) ([]SearchResult, bool, error) {
+	prefix := searchPrefix(q)
+	if prefix == "" {
+		return []SearchResult{}, false, nil
+	}
+
+	fetch := func(ctx context.Context, afterID, n int) ([]Record, error) {
+		rows, err := p.Query(ctx, searchInAppSQL, prefix+"%", "% "+prefix+"%", afterID, n)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		batch := make([]Record, 0, n)
+		for rows.Next() {
+			var rec Record
+			err = rows.Scan(&rec.Id, &rec.Name, &rec.Phone)
+			if err != nil {
+				return nil, err
+			}
+			batch = append(batch, rec)
+		}
+		return batch, rows.Err()
+	}
+
+	return rankCandidates(ctx, fetch, q, limit)
+}
+
+// rankCandidates reads the candidates page by page and returns the best
+// limit of them. It stops after maxSearchCandidates and reports whether
+// there were more.
+func rankCandidates(ctx context.Context, fetch fetchCandidates, q string, limit int) (
+	results []SearchResult, truncated bool, err error) {
+	qTrgm := trigrams(q)
+	results = make([]SearchResult, 0, limit)
+	scanned := 0
+	afterID := 0
+	for {
+		batch, err := fetch(ctx, afterID, searchBatchSize)
+		if err != nil {
+			return nil, false, err
+		}
+
+		for _, rec := range batch {
+			if scanned == maxSearchCandidates {
+				truncated = true
+				break
+			}
+			scanned++
+
+			score := similarity(qTrgm, trigrams(rec.Name))
+			if score < searchThreshold {
+				continue
+			}
+
+			results = append(results, SearchResult{Record: rec, Score: score})
+			// Don't keep all the candidates in memory
+			if len(results) > 2*limit {
+				sortSearchResults(results)
+				results = results[:limit]
+			}
+		}
+
+		if truncated || len(batch) < searchBatchSize {
+			break
+		}
+		afterID = batch[len(batch)-1].Id
+	}
+
+	sortSearchResults(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, truncated, nil
+}
+
+func sortSearchResults(results []SearchResult) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Record.Id < results[j].Record.Id
+	})
+}
+
+// trigrams returns a set of trigrams the same way pg_trgm does: the string
+// is lower-cased and split into words of alphanumeric characters, each word
+// is padded with two spaces in front and one space after.
+func trigrams(s string) map[string]struct{} {
+	result := make(map[string]struct{})
+	words := strings.FieldsFunc(strings.ToLower(s), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	for _, word := range words {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			result[string(padded[i:i+3])] = struct{}{}
+		}
+	}
+	return result
+}
+
+// similarity is the number of shared trigrams divided by the number of
+// trigrams in both sets, same as pg_trgm's similarity().
+func similarity(a, b map[string]struct{}) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	common := 0
+	for t := range a {
+		if _, ok := b[t]; ok {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
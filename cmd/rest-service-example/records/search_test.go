@@ -0,0 +1,91 @@
+package records
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSimilarity(t *testing.T) {
+	t.Parallel()
+
+	// Expected values are the ones returned by pg_trgm's similarity()
+	cases := []struct {
+		a, b  string
+		score float64
+	}{
+		{"Alice", "Alice", 1},
+		{"Alice", "ALICE", 1},
+		{"Alice", "Alcie", 0.2},
+		{"Alice", "Bob", 0},
+		{"word", "two words", 4.0 / 11.0},
+		{"", "Alice", 0},
+	}
+
+	for _, c := range cases {
+		score := similarity(trigrams(c.a), trigrams(c.b))
+		require.InDelta(t, c.score, score, 1e-9, "%s vs %s", c.a, c.b)
+	}
+}
+
+func TestSearchPrefix(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		q      string
+		prefix string
+	}{
+		{"Alice", "al"},
+		{"  ÄLICE Smith", "äl"},
+		{"A", "a"},
+		{"%_ bob", "bo"},
+		{"%_\\", ""},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.prefix, searchPrefix(c.q), c.q)
+	}
+}
+
+func TestRankCandidates(t *testing.T) {
+	t.Parallel()
+
+	// Ordered by id like the query results
+	var candidates []Record
+	fetches := 0
+	fetch := func(ctx context.Context, afterID, n int) ([]Record, error) {
+		fetches++
+		var batch []Record
+		for _, rec := range candidates {
+			if rec.Id > afterID && len(batch) < n {
+				batch = append(batch, rec)
+			}
+		}
+		return batch, nil
+	}
+
+	filler := func(n int) {
+		for i := 0; i < n; i++ {
+			candidates = append(candidates, Record{Id: len(candidates) + 1, Name: "Alqwrtypsdfgh"})
+		}
+	}
+
+	// The best match is on the last page
+	filler(maxSearchCandidates - 1)
+	candidates = append(candidates, Record{Id: maxSearchCandidates, Name: "Alice"})
+	results, truncated, err := rankCandidates(context.Background(), fetch, "Alcie", 3)
+	require.NoError(t, err)
+	require.False(t, truncated)
+	require.Len(t, results, 1)
+	require.Equal(t, "Alice", results[0].Record.Name)
+	require.Equal(t, maxSearchCandidates/searchBatchSize+1, fetches)
+
+	// A match beyond the limit of candidates is not found, but the client
+	// is told about it
+	candidates[len(candidates)-1].Name = "Alqwrtypsdfgh"
+	candidates = append(candidates, Record{Id: maxSearchCandidates + 1, Name: "Alice"})
+	results, truncated, err = rankCandidates(context.Background(), fetch, "Alcie", 3)
+	require.NoError(t, err)
+	require.True(t, truncated)
+	require.Empty(t, results)
+}
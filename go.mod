@@ -1,10 +1,11 @@
 module github.com/afiskon/go-rest-service-example
 
-go 1.12
+go 1.16
 
 require (
 	github.com/coreos/go-systemd v0.0.0-20190719114852-fd7a80b32e1f // indirect
 	github.com/gorilla/mux v1.7.3
+	github.com/jackc/pgconn v1.1.0
 	github.com/jackc/pgx/v4 v4.1.2
 	github.com/kr/pty v1.1.8 // indirect
 	github.com/ory/dockertest/v3 v3.5.2
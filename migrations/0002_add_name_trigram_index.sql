@@ -0,0 +1,17 @@
+-- migrate:tx=none
+{{if .CockroachDB}}
+-- CockroachDB doesn't support pg_trgm, records.Search ranks records
+-- in the application instead. Nothing to create here.
+SELECT 1;
+{{else}}
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+-- Doesn't block writes to the table while the index is built
+CREATE INDEX CONCURRENTLY IF NOT EXISTS phonebook_name_trgm_idx ON phonebook USING gin (name gin_trgm_ops);
+{{end}}
+---- create above / drop below ----
+{{if .CockroachDB}}
+SELECT 1;
+{{else}}
+-- The extension is left in place, other objects may depend on it
+DROP INDEX CONCURRENTLY IF EXISTS phonebook_name_trgm_idx;
+{{end}}
@@ -0,0 +1,28 @@
+// Package migrations embeds the SQL migrations into the binary, so that the
+// service doesn't depend on the working directory.
+package migrations
+
+import (
+	"embed"
+
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/backfill"
+	"github.com/afiskon/go-rest-service-example/cmd/rest-service-example/migrate"
+)
+
+// FS contains the migrations at its root, including the repeatable R__*.sql
+// ones, shared templates are in subdirectories
+//
+//go:embed *
+var FS embed.FS
+
+// Go contains the migrations which can't be expressed in SQL. They share
+// the sequence numbers with the files in FS, e.g. 0003 can be a Go migration
+// between 0002_*.sql and 0004_*.sql. With timestamp versioning they set
+// Version instead of Sequence.
+var Go []migrate.GoMigration
+
+// Backfills contains the data migrations which are too large for a single
+// transaction. They are run separately by `migrate backfill run <name>`,
+// usually after a migration which makes the schema compatible with both
+// the old and the new data.
+var Backfills []backfill.Backfill